@@ -0,0 +1,264 @@
+// Command admin manages accounts directly against the database, e.g. to create the first
+// admin, which cannot be done through the API.
+//
+//	admin create-superuser -email admin@post.io -username admin
+//	admin promote -email agent@post.io [-role supervisor]
+//	admin demote -email agent@post.io
+//	admin reset-password -email user@post.io
+//	admin list-users
+//
+// The connection is configured with the same DB_* envvars the service uses. Passwords not
+// passed with -password are read from stdin.
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"db-queries/db"
+	"db-queries/passwords"
+
+	"github.com/joho/godotenv"
+	"github.com/lib/pq"
+	"golang.org/x/term"
+)
+
+type command struct {
+	usage string
+	run   func(conn *sql.DB, args []string) error
+}
+
+var commands = map[string]command{
+	"create-superuser": {"-email <email> -username <username> [-password <password>]", createSuperuser},
+	"promote":          {"-email <email> [-role <role>]", promote},
+	"demote":           {"-email <email>", demote},
+	"reset-password":   {"-email <email> [-password <password>]", resetPassword},
+	"list-users":       {"", listUsers},
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("WARNING. Unable to parse .env file.")
+	}
+	passwords.LoadCostFromEnv()
+
+	conn, err := db.Initialize(db.NewDSNFromEnv())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := db.CreateRelations(conn); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := cmd.run(conn, os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: admin <command> [flags]\n\nCommands:")
+	for _, name := range []string{"create-superuser", "promote", "demote", "reset-password", "list-users"} {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+	}
+	os.Exit(2)
+}
+
+func createSuperuser(conn *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("create-superuser", flag.ExitOnError)
+	email := fs.String("email", "", "email of the admin")
+	username := fs.String("username", "", "username of the admin")
+	password := fs.String("password", "", "password (read from stdin if omitted)")
+	fs.Parse(args)
+
+	if _, err := mail.ParseAddress(*email); err != nil || *username == "" {
+		return fmt.Errorf("valid -email and -username required")
+	}
+
+	pass, err := passwordFromFlagOrStdin(*password)
+	if err != nil {
+		return err
+	}
+
+	hash, err := passwords.Hash(pass)
+	if err != nil {
+		return err
+	}
+
+	id, err := db.CreateUser(conn, *email, hash, *username, db.ROLE_ADMIN)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == db.UNIQUE_VIOLATION_ERR_CODE_NAME {
+		return fmt.Errorf("user %s already exists, use promote -role admin instead", *email)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := db.MarkEmailVerified(conn, id); err != nil {
+		return err
+	}
+	fmt.Printf("Admin %s created with id %d.\n", *email, id)
+	return nil
+}
+
+func promote(conn *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	email := fs.String("email", "", "email of the user")
+	role := fs.String("role", db.ROLE_AGENT, "role to grant: "+strings.Join(validRoles(), ", "))
+	fs.Parse(args)
+
+	if !db.VALID_ROLES[*role] {
+		return fmt.Errorf("unknown role %q", *role)
+	}
+
+	user, err := userByEmail(conn, *email)
+	if err != nil {
+		return err
+	}
+
+	if err := db.SetUserRole(conn, user.ID, *role); err != nil {
+		return err
+	}
+	fmt.Printf("User %s now has the %s role.\n", user.Email, *role)
+	return nil
+}
+
+func demote(conn *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("demote", flag.ExitOnError)
+	email := fs.String("email", "", "email of the user")
+	fs.Parse(args)
+
+	user, err := userByEmail(conn, *email)
+	if err != nil {
+		return err
+	}
+
+	if err := db.SetUserRole(conn, user.ID, db.ROLE_CUSTOMER); err != nil {
+		return err
+	}
+	fmt.Printf("User %s demoted to %s.\n", user.Email, db.ROLE_CUSTOMER)
+	return nil
+}
+
+func resetPassword(conn *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("reset-password", flag.ExitOnError)
+	email := fs.String("email", "", "email of the user")
+	password := fs.String("password", "", "new password (read from stdin if omitted)")
+	fs.Parse(args)
+
+	user, err := userByEmail(conn, *email)
+	if err != nil {
+		return err
+	}
+	if user.SingleSignOn {
+		return fmt.Errorf("user %s logs in with single sign-on and has no password", user.Email)
+	}
+
+	pass, err := passwordFromFlagOrStdin(*password)
+	if err != nil {
+		return err
+	}
+
+	hash, err := passwords.Hash(pass)
+	if err != nil {
+		return err
+	}
+
+	err = db.SetPassword(conn, user.ID, hash)
+	if err == db.ErrPasswordSingleSignOn {
+		return fmt.Errorf("user %s logs in with single sign-on and has no password", user.Email)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Password of %s reset, all their sessions ended.\n", user.Email)
+	return nil
+}
+
+func listUsers(conn *sql.DB, args []string) error {
+	users, err := db.GetAllUsers(conn)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tUSERNAME\tROLE\tVERIFIED\tACTIVE\tTICKETS\tCREATED")
+	for _, u := range users {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%t\t%t\t%d\t%s\n", u.ID, u.Email, u.Username,
+			u.Role, u.EmailVerified, u.Active, u.TicketsCount, u.CrtdAt.Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
+
+func validRoles() []string {
+	roles := make([]string, 0, len(db.VALID_ROLES))
+	for role := range db.VALID_ROLES {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+func userByEmail(conn *sql.DB, email string) (db.User, error) {
+	if email == "" {
+		return db.User{}, fmt.Errorf("-email required")
+	}
+	user, err := db.GetUserByEmail(conn, email)
+	if err == sql.ErrNoRows {
+		return user, fmt.Errorf("user %s not found", email)
+	}
+	return user, err
+}
+
+func passwordFromFlagOrStdin(password string) (string, error) {
+	if password == "" {
+		var err error
+		if password, err = readPassword(); err != nil {
+			return "", fmt.Errorf("unable to read password: %w", err)
+		}
+	}
+
+	policy, err := passwords.NewPolicyFromEnv()
+	if err != nil {
+		return "", err
+	}
+	if err := policy.Validate(password); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// readPassword prompts for the password without echoing it when stdin is a terminal, and
+// reads the first line of stdin otherwise, e.g. when the password is piped in.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
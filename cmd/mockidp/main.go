@@ -0,0 +1,34 @@
+// Command mockidp is an OpenID Connect provider for trying out and testing the single sign-on
+// locally. It logs anybody in without asking: as the user given by the flags, or by the
+// login_hint and groups query parameters of the authorization request.
+//
+//	mockidp -addr :9999 -issuer http://localhost:9999 -email agent@corp.io -groups support-agents
+//
+// The service is then pointed at it with OIDC_ISSUER=http://localhost:9999, OIDC_CLIENT_ID and
+// OIDC_CLIENT_SECRET matching -client-id and -client-secret.
+package main
+
+import (
+	"db-queries/oidc/mockidp"
+	"flag"
+	"log"
+	"net/http"
+)
+
+func main() {
+	addr := flag.String("addr", ":9999", "address to listen on")
+	issuer := flag.String("issuer", "http://localhost:9999", "issuer, the url the provider is reached at")
+	clientID := flag.String("client-id", "ticket-service", "the only client id accepted")
+	clientSecret := flag.String("client-secret", "secret", "the secret of the client")
+	email := flag.String("email", "agent@corp.io", "email of the user logged in, unless login_hint is passed")
+	groups := flag.String("groups", "support-agents", "comma separated groups of the user, unless groups is passed")
+	flag.Parse()
+
+	p, err := mockidp.New(*issuer, *clientID, *clientSecret, *email, *groups)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Mock OIDC provider %s listening at %s", p.Issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, p.Handler()))
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"database/sql"
+	"db-queries/db"
+	"sync"
+	"time"
+)
+
+type userAccess struct {
+	active           bool
+	tokensValidAfter time.Time
+	fetchedAt        time.Time
+}
+
+// accessCache saves the middleware a database round trip per request for checking whether
+// the user has been deactivated since the token was issued.
+// The ttl bounds how long a deactivation takes to apply to the tokens already issued, when the
+// service runs as more than one instance.
+type accessCache struct {
+	mu    sync.Mutex
+	users map[int]userAccess
+	ttl   time.Duration
+}
+
+func newAccessCache(ttl time.Duration) *accessCache {
+	return &accessCache{users: map[int]userAccess{}, ttl: ttl}
+}
+
+func (c *accessCache) get(conn *sql.DB, userID int) (userAccess, error) {
+	c.mu.Lock()
+	access, found := c.users[userID]
+	c.mu.Unlock()
+	if found && time.Since(access.fetchedAt) < c.ttl {
+		return access, nil
+	}
+
+	active, tokensValidAfter, err := db.GetUserAccess(conn, userID)
+	if err != nil {
+		return access, err
+	}
+	access = userAccess{active, tokensValidAfter, time.Now()}
+
+	c.mu.Lock()
+	c.users[userID] = access
+	c.mu.Unlock()
+	return access, nil
+}
+
+// forget makes the next check of the user go to the database.
+func (c *accessCache) forget(userID int) {
+	c.mu.Lock()
+	delete(c.users, userID)
+	c.mu.Unlock()
+}
+
+// accepts tells whether a token issued at iat may still be used. Token timestamps are
+// in whole seconds, hence the truncation.
+func (a userAccess) accepts(iat time.Time) bool {
+	return a.active && !iat.Before(a.tokensValidAfter.Truncate(time.Second))
+}
@@ -0,0 +1,237 @@
+package controllers
+
+import (
+	"database/sql"
+	"db-queries/db"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const API_KEY_PREFIX = "csk_"
+const API_KEY_DISPLAYED_PREFIX_LENGTH = 12
+
+const (
+	SCOPE_TICKETS_READ   = "tickets:read"
+	SCOPE_TICKETS_WRITE  = "tickets:write"
+	SCOPE_MESSAGES_WRITE = "messages:write"
+	SCOPE_STAFF_ONBOARD  = "staff:onboard"
+)
+
+var (
+	VALID_API_KEY_SCOPES = map[string]bool{
+		SCOPE_TICKETS_READ:   true,
+		SCOPE_TICKETS_WRITE:  true,
+		SCOPE_MESSAGES_WRITE: true,
+		SCOPE_STAFF_ONBOARD:  true,
+	}
+	// The keys owned by customers only read, whoever has issued them.
+	VALID_CUSTOMER_API_KEY_SCOPES = map[string]bool{
+		SCOPE_TICKETS_READ: true,
+	}
+	apiKeyOperationRegex, _ = regexp.Compile("^/api-keys/[0-9]+[/]?$")
+)
+
+type ApiKeyDetails struct {
+	Name      string     `json:"name"`
+	OwnerID   int        `json:"ownerId"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+type CreatedApiKey struct {
+	db.ApiKey
+	Key string `json:"key"`
+}
+
+// Methods: GET/POST; path: /api-keys
+func (h *BaseHandler) ApiKeysListAllOrCreateOne(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !authorize(w, authReq, db.PERM_API_KEYS_MANAGE) {
+		return
+	}
+
+	switch authReq.Method {
+	case "GET":
+		h.GetAllApiKeys(w, authReq)
+	case "POST":
+		h.CreateApiKey(w, authReq)
+	default:
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// Methods: DELETE; path: /api-keys/{id}
+func (h *BaseHandler) ApiKeysDetailedView(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !authorize(w, authReq, db.PERM_API_KEYS_MANAGE) {
+		return
+	}
+
+	if !apiKeyOperationRegex.MatchString(authReq.URL.Path) {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	keyId := strings.Split(authReq.URL.Path, "/")[ID_POSITION_IN_URL_PATH]
+	switch authReq.Method {
+	case "DELETE":
+		h.RevokeApiKey(keyId, w, authReq)
+	default:
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *BaseHandler) GetAllApiKeys(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	keys, err := db.GetAllApiKeys(h.Conn)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(keys)
+}
+
+// CreateApiKey issues a key acting on behalf of its owner (the admin themselves unless
+// ownerId is given) within the given scopes. The key is only ever shown in this response.
+// Acting on behalf of another user takes the right to impersonate them, and is audited.
+func (h *BaseHandler) CreateApiKey(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	var details ApiKeyDetails
+	err := json.NewDecoder(authReq.Body).Decode(&details)
+	if err != nil || details.Name == "" || len(details.Scopes) == 0 {
+		http.Error(w, "Missing fields in payload: expected name and scopes.", http.StatusBadRequest)
+		return
+	}
+
+	if !validScopes(w, details.Scopes, VALID_API_KEY_SCOPES) {
+		return
+	}
+
+	if details.ExpiresAt != nil && details.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Expiry date is in the past.", http.StatusBadRequest)
+		return
+	}
+
+	if details.OwnerID == 0 {
+		details.OwnerID = authReq.user.ID
+	}
+	onBehalf := details.OwnerID != authReq.user.ID
+	if onBehalf && !authReq.user.can(db.PERM_USERS_IMPERSONATE) {
+		http.Error(w, "No permissions to issue keys on behalf of other users.", http.StatusForbidden)
+		return
+	}
+	owner, err := db.GetUserByID(h.Conn, details.OwnerID)
+	if err != nil {
+		http.Error(w, "Owner not found.", http.StatusBadRequest)
+		return
+	}
+	if !db.IsStaffRole(owner.Role) && !validScopes(w, details.Scopes, VALID_CUSTOMER_API_KEY_SCOPES) {
+		return
+	}
+
+	created, err := h.issueApiKey(details.OwnerID, authReq.user.ID, db.API_KEY_KIND_ADMIN, details.Name,
+		details.Scopes, details.ExpiresAt)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if onBehalf {
+		h.audit(authReq.user.ID, owner.ID, db.AUDIT_API_KEY_CREATE,
+			map[string]interface{}{"key_id": created.ID, "name": created.Name, "scopes": created.Scopes})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// validScopes responds with 400 and returns false if any of the scopes is not among the valid ones.
+func validScopes(w http.ResponseWriter, scopes []string, valid map[string]bool) bool {
+	for _, scope := range scopes {
+		if !valid[scope] {
+			http.Error(w, "Invalid scope: "+scope, http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+// issueApiKey generates a key and stores its hash. The key is only ever part of the returned value.
+func (h *BaseHandler) issueApiKey(owner, createdBy int, kind, name string, scopes []string,
+	expiresAt *time.Time) (CreatedApiKey, error) {
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return CreatedApiKey{}, err
+	}
+	key := API_KEY_PREFIX + secret
+
+	created, err := db.CreateApiKey(h.Conn, owner, createdBy, kind, name, key[:API_KEY_DISPLAYED_PREFIX_LENGTH],
+		hashToken(key), scopes, expiresAt)
+	if err != nil {
+		return CreatedApiKey{}, err
+	}
+	return CreatedApiKey{created, key}, nil
+}
+
+func (h *BaseHandler) RevokeApiKey(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !db.RevokeApiKey(h.Conn, id) {
+		http.Error(w, "API key does not exist or has already been revoked.", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticateApiKey resolves the key to its owner. The resulting requester is limited
+// to the key's scopes.
+func (h *BaseHandler) authenticateApiKey(res http.ResponseWriter, key string) (requester Requester, ok bool) {
+	keyID, scopes, owner, err := db.UseApiKey(h.Conn, hashToken(key))
+	if err == sql.ErrNoRows {
+		http.Error(res, "API key invalid.", http.StatusUnauthorized)
+		return requester, false
+	}
+	if err != nil {
+		http.Error(res, "Please try again later.", http.StatusInternalServerError)
+		return requester, false
+	}
+
+	permissions, err := db.GetPermissionsOfRole(h.Conn, owner.Role)
+	if err != nil {
+		http.Error(res, "Please try again later.", http.StatusInternalServerError)
+		return requester, false
+	}
+
+	return Requester{
+		ID:            owner.ID,
+		Username:      owner.Username,
+		Email:         owner.Email,
+		Role:          owner.Role,
+		Permissions:   permissions,
+		EmailVerified: owner.EmailVerified,
+		ApiKeyID:      keyID,
+		Scopes:        scopes,
+	}, true
+}
+
+// hasScope reports whether the credentials of the request allow the action.
+// Only API keys and personal access tokens are limited by scopes, sessions are not.
+func (r Requester) hasScope(scope string) bool {
+	return r.ApiKeyID == 0 || containsScope(r.Scopes, scope)
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// requireScope responds with 403 and returns false if the request lacks the scope.
+func requireScope(w http.ResponseWriter, authReq *AuthenticatedRequest, scope string) bool {
+	if authReq.user.hasScope(scope) {
+		return true
+	}
+	http.Error(w, "Token lacks the required scope: "+scope, http.StatusForbidden)
+	return false
+}
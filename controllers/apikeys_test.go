@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidScopes(t *testing.T) {
+	cases := []struct {
+		scopes  []string
+		valid   map[string]bool
+		invalid string
+	}{
+		{[]string{SCOPE_TICKETS_READ, SCOPE_STAFF_ONBOARD}, VALID_API_KEY_SCOPES, ""},
+		{[]string{SCOPE_TICKETS_READ, SCOPE_TICKETS_WRITE, SCOPE_MESSAGES_WRITE}, VALID_PERSONAL_TOKEN_SCOPES, ""},
+		{[]string{SCOPE_TICKETS_READ, SCOPE_STAFF_ONBOARD}, VALID_PERSONAL_TOKEN_SCOPES, SCOPE_STAFF_ONBOARD},
+		{[]string{"tickets:*"}, VALID_API_KEY_SCOPES, "tickets:*"},
+		{[]string{"Tickets:Read"}, VALID_API_KEY_SCOPES, "Tickets:Read"},
+		{[]string{SCOPE_TICKETS_READ}, VALID_CUSTOMER_API_KEY_SCOPES, ""},
+		{[]string{SCOPE_TICKETS_READ, SCOPE_TICKETS_WRITE}, VALID_CUSTOMER_API_KEY_SCOPES, SCOPE_TICKETS_WRITE},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		ok := validScopes(rec, c.scopes, c.valid)
+		if ok != (c.invalid == "") {
+			t.Errorf("%v: got %v, want %v", c.scopes, ok, c.invalid == "")
+			continue
+		}
+		if !ok && (rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), c.invalid)) {
+			t.Errorf("%v: got %d %q, want 400 naming %s", c.scopes, rec.Code, rec.Body.String(), c.invalid)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package controllers
+
+import (
+	"db-queries/db"
+	"log"
+)
+
+// audit records the action in the audit log. The action having been taken already, a failure
+// to record it is only logged.
+func (h *BaseHandler) audit(actorID, subjectID int, action string, details interface{}) {
+	if err := db.AddAuditRecord(h.Conn, actorID, subjectID, action, details); err != nil {
+		log.Printf("Unable to record %s of user %d by %d: %v", action, subjectID, actorID, err)
+	}
+}
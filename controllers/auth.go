@@ -1,33 +1,61 @@
 package controllers
 
 import (
+	"database/sql"
 	"db-queries/db"
+	"db-queries/passwords"
 	"encoding/json"
+	"log"
 	"net/http"
 	"net/mail"
-	"os"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 )
 
-var JWT_KEY = []byte(os.Getenv("JWT_KEY"))
-
 const COOKIE_NAME = "token"
+const COOKIE_PATH = "/"
 const TOKEN_TTL_MINS = 30
+const REFRESH_COOKIE_NAME = "refresh_token"
+const REFRESH_COOKIE_PATH = "/refresh"
+const REFRESH_TOKEN_TTL_DAYS = 30
 
 type Credentials struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	ReturnToken bool   `json:"returnToken"`
+}
+type RefreshDetails struct {
+	RefreshToken string `json:"refreshToken"`
+}
+type TokenResponse struct {
+	AccessToken      string    `json:"accessToken"`
+	TokenType        string    `json:"tokenType"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+	RefreshToken     string    `json:"refreshToken"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+	CSRFToken        string    `json:"csrfToken"`
 }
 type Claims struct {
-	Username    string `json:"username"`
-	Email       string `json:"email"`
-	IsStaff     bool   `json:"isStaff"`
-	IsSuperuser bool   `json:"isSuperuser"`
+	Username      string   `json:"username"`
+	Email         string   `json:"email"`
+	Role          string   `json:"role"`
+	Permissions   []string `json:"permissions"`
+	EmailVerified bool     `json:"emailVerified"`
+	SessionID     string   `json:"sid"`
+	Purpose       string   `json:"purpose,omitempty"`
+	Actor         *Actor   `json:"act,omitempty"`
+	CSRFHash      string   `json:"csrf,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// Actor is the one acting on behalf of the subject of the token, as in RFC 8693.
+type Actor struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email"`
+}
+
 func (h *BaseHandler) LogIn(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "OPTIONS" {
 		return
@@ -50,37 +78,303 @@ func (h *BaseHandler) LogIn(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Valid email address and password required.", http.StatusBadRequest)
 		return
 	}
+	if len(creds.Password) > passwords.MAX_LENGTH_BYTES {
+		http.Error(w, "Password max length is "+strconv.Itoa(passwords.MAX_LENGTH_BYTES)+" bytes.", http.StatusBadRequest)
+		return
+	}
 
-	user, err := db.GetUserDetails(h.Conn, creds.Email, creds.Password)
+	ip := h.clientIP(r)
+	attempt, lockedFor, err := h.reserveLoginAttempt(creds.Email, ip)
 	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if lockedFor > 0 {
+		h.recordLogin(r, creds.Email, db.LOGIN_METHOD_PASSWORD, db.LOGIN_LOCKED)
+		tooManyLoginAttempts(w, lockedFor)
+		return
+	}
+
+	user, err := h.verifyPassword(creds.Email, creds.Password)
+	if err == sql.ErrNoRows {
+		h.registerLoginFailure(creds.Email, ip)
+		h.recordLogin(r, creds.Email, db.LOGIN_METHOD_PASSWORD, db.LOGIN_INVALID_CREDENTIALS)
 		http.Error(w, "User with specified credentials not found.", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		h.releaseLoginAttempt(attempt)
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.registerLoginSuccess(creds.Email)
+	h.releaseLoginAttempt(attempt)
+
+	if !user.Active {
+		h.recordLogin(r, user.Email, db.LOGIN_METHOD_PASSWORD, db.LOGIN_DEACTIVATED)
+		http.Error(w, "Account deactivated.", http.StatusForbidden)
+		return
+	}
+
+	if !user.EmailVerified && h.Config.UnverifiedUsersPolicy == UNVERIFIED_POLICY_BLOCK {
+		h.recordLogin(r, user.Email, db.LOGIN_METHOD_PASSWORD, db.LOGIN_UNVERIFIED)
+		http.Error(w, "Email address not verified.", http.StatusForbidden)
+		return
+	}
+
+	sessionID, err := newTokenID()
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	if user.TotpEnabled || (h.Config.MFARequiredForStaff && db.IsStaffRole(user.Role)) {
+		h.requireSecondFactor(w, user, sessionID)
+		return
+	}
+
+	tokens, err := h.startSession(w, user, sessionID)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.recordLoginSuccess(r, user, db.LOGIN_METHOD_PASSWORD)
+	if creds.ReturnToken {
+		writeTokenResponse(w, tokens)
+	}
+}
+
+// verifyPassword returns the user with the email if the password is theirs, sql.ErrNoRows
+// otherwise, whether the email is unknown or the password wrong. A hash made with an
+// outdated algorithm or cost is replaced along the way.
+func (h *BaseHandler) verifyPassword(email, password string) (db.User, error) {
+	// No password this long is ever accepted, hashing it would only cost time.
+	if len(password) > passwords.MAX_LENGTH_BYTES {
+		return db.User{}, sql.ErrNoRows
+	}
+	user, hash, err := db.GetUserWithPasswordHash(h.Conn, email)
+	if err == sql.ErrNoRows {
+		// Hashing anyway keeps the response time from telling the unknown emails apart.
+		passwords.Hash(password)
+		return user, err
+	}
+	if err != nil {
+		return user, err
+	}
+
+	ok, needsRehash, err := passwords.Verify(password, hash)
+	if err != nil {
+		return user, err
+	}
+	if !ok {
+		return user, sql.ErrNoRows
+	}
+
+	if needsRehash {
+		newHash, err := passwords.Hash(password)
+		if err == nil {
+			err = db.RehashPassword(h.Conn, user.ID, hash, newHash)
+		}
+		if err != nil {
+			log.Printf("Unable to rehash the password of user %d: %v", user.ID, err)
+		}
+	}
+	return user, nil
+}
+
+// startSession stores a refresh token for the session, signs an access token and sets
+// both as cookies.
+func (h *BaseHandler) startSession(w http.ResponseWriter, user db.User, sessionID string) (tokens TokenResponse, err error) {
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		return tokens, err
+	}
+
+	csrfToken, err := newOpaqueToken()
+	if err != nil {
+		return tokens, err
+	}
+
+	refreshTtl := time.Now().Add(REFRESH_TOKEN_TTL_DAYS * 24 * time.Hour)
+	err = db.CreateRefreshToken(h.Conn, user.ID, sessionID, hashToken(refreshToken), hashToken(csrfToken), refreshTtl)
+	if err != nil {
+		return tokens, err
+	}
+
+	ttl := time.Now().Add(TOKEN_TTL_MINS * time.Minute)
+	tokenString, err := h.createTokenForUser(user, nil, sessionID, "", hashToken(csrfToken), ttl)
+	if err != nil {
+		return tokens, err
+	}
+
+	tokens = newTokenResponse(tokenString, ttl, refreshToken, refreshTtl, csrfToken)
+	h.setAuthCookies(w, tokens)
+	return tokens, nil
+}
+
+// Methods: POST; path: /refresh
+// The refresh token is read from the cookie, or, for clients not using cookies,
+// from the payload, in which case the new tokens are returned in the response body.
+func (h *BaseHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var presentedToken string
+	fromBody := false
+	if cookie, errorNoCookie := r.Cookie(REFRESH_COOKIE_NAME); errorNoCookie == nil {
+		presentedToken = cookie.Value
+	} else {
+		var details RefreshDetails
+		if r.Body != nil {
+			json.NewDecoder(r.Body).Decode(&details)
+		}
+		presentedToken, fromBody = details.RefreshToken, true
+	}
+	if presentedToken == "" {
+		http.Error(w, "Refresh token missing in 'Cookie' headers or payload.", http.StatusUnauthorized)
+		return
+	}
+
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	csrfToken, err := newOpaqueToken()
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	// The browser attaches the cookie to requests made by other sites as well, so the csrf
+	// token issued along with the refresh token has to come with it, as for checkCSRF.
+	presentedCSRFHash := ""
+	if csrf := r.Header.Get(CSRF_HEADER_NAME); csrf != "" {
+		presentedCSRFHash = hashToken(csrf)
+	}
+
+	refreshTtl := time.Now().Add(REFRESH_TOKEN_TTL_DAYS * 24 * time.Hour)
+	userID, sessionID, err := db.RotateRefreshToken(h.Conn, hashToken(presentedToken), hashToken(refreshToken),
+		!fromBody, presentedCSRFHash, hashToken(csrfToken), refreshTtl)
+	switch err {
+	case nil:
+	case db.ErrRefreshTokenCSRF:
+		http.Error(w, "CSRF token missing or invalid.", http.StatusForbidden)
+		return
+	case db.ErrRefreshTokenNotFound, db.ErrRefreshTokenExpired, db.ErrRefreshTokenReused, db.ErrRefreshTokenNoCSRF:
+		h.clearAuthCookies(w)
+		http.Error(w, "Refresh token invalid.", http.StatusUnauthorized)
+		return
+	default:
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := db.GetUserByID(h.Conn, userID)
+	if err != nil {
+		h.clearAuthCookies(w)
+		http.Error(w, "User not found.", http.StatusUnauthorized)
+		return
+	}
 
 	ttl := time.Now().Add(TOKEN_TTL_MINS * time.Minute)
-	tokenString, err := createTokenForUser(user, ttl)
+	tokenString, err := h.createTokenForUser(user, nil, sessionID, "", hashToken(csrfToken), ttl)
 	if err != nil {
 		http.Error(w, "Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:    COOKIE_NAME,
-		Value:   tokenString,
-		Expires: ttl,
-	})
+	tokens := newTokenResponse(tokenString, ttl, refreshToken, refreshTtl, csrfToken)
+	if fromBody {
+		writeTokenResponse(w, tokens)
+		return
+	}
+	h.setAuthCookies(w, tokens)
+}
+
+// Methods: POST; path: /logout
+func (h *BaseHandler) LogOut(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if authReq.Method != "POST" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	until := time.Now().Add(TOKEN_TTL_MINS * time.Minute)
+	if err := db.RevokeSession(h.Conn, authReq.user.SessionID, authReq.user.TokenID, until); err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	h.clearAuthCookies(w)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func createTokenForUser(user db.User, ttl time.Time) (tokenString string, err error) {
+func newTokenResponse(token string, ttl time.Time, refreshToken string, refreshTtl time.Time, csrfToken string) TokenResponse {
+	return TokenResponse{
+		AccessToken:      token,
+		TokenType:        "Bearer",
+		ExpiresAt:        ttl,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshTtl,
+		CSRFToken:        csrfToken,
+	}
+}
+
+// setAuthCookies sets the tokens as cookies. Unlike the other two, the csrf cookie is readable
+// by the scripts of the app, which send it back in the X-CSRF-Token header.
+func (h *BaseHandler) setAuthCookies(w http.ResponseWriter, tokens TokenResponse) {
+	http.SetCookie(w, h.newCookie(COOKIE_NAME, tokens.AccessToken, COOKIE_PATH, tokens.ExpiresAt, true))
+	http.SetCookie(w, h.newCookie(REFRESH_COOKIE_NAME, tokens.RefreshToken, REFRESH_COOKIE_PATH, tokens.RefreshExpiresAt, true))
+	// Lasts as long as the refresh token, which needs it after the access token has expired.
+	http.SetCookie(w, h.newCookie(CSRF_COOKIE_NAME, tokens.CSRFToken, COOKIE_PATH, tokens.RefreshExpiresAt, false))
+}
+
+func writeTokenResponse(w http.ResponseWriter, tokens TokenResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (h *BaseHandler) clearAuthCookies(w http.ResponseWriter) {
+	http.SetCookie(w, h.expiredCookie(COOKIE_NAME, COOKIE_PATH, true))
+	http.SetCookie(w, h.expiredCookie(REFRESH_COOKIE_NAME, REFRESH_COOKIE_PATH, true))
+	http.SetCookie(w, h.expiredCookie(CSRF_COOKIE_NAME, COOKIE_PATH, false))
+}
+
+// createTokenForUser signs a jwt for the user. A token with a non-empty purpose is only
+// accepted by the endpoints of the login step it has been issued for. A token with an actor
+// is an impersonation one, see ImpersonateUser. A token sent as a cookie needs csrfHash, see
+// checkCSRF.
+func (h *BaseHandler) createTokenForUser(user db.User, actor *Actor, sessionID, purpose, csrfHash string,
+	ttl time.Time) (tokenString string, err error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	permissions, err := db.GetPermissionsOfRole(h.Conn, user.Role)
+	if err != nil {
+		return "", err
+	}
+
 	claims := &Claims{
-		Username:    user.Username,
-		Email:       user.Email,
-		IsStaff:     user.IsStaff,
-		IsSuperuser: user.IsSuperuser,
+		Username:      user.Username,
+		Email:         user.Email,
+		Role:          user.Role,
+		Permissions:   permissions,
+		EmailVerified: user.EmailVerified,
+		SessionID:     sessionID,
+		Purpose:       purpose,
+		Actor:         actor,
+		CSRFHash:      csrfHash,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   strconv.Itoa(user.ID),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			ExpiresAt: jwt.NewNumericDate(ttl),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(JWT_KEY)
+	return h.Keys.sign(claims)
 }
@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"db-queries/db"
+	"db-queries/passwords"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// refresh runs POST /refresh with the refresh cookie and, unless empty, the csrf header.
+func refresh(h *BaseHandler, refreshToken, csrfToken string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/refresh", nil)
+	r.AddCookie(&http.Cookie{Name: REFRESH_COOKIE_NAME, Value: refreshToken})
+	if csrfToken != "" {
+		r.Header.Set(CSRF_HEADER_NAME, csrfToken)
+	}
+	rec := httptest.NewRecorder()
+	h.Refresh(rec, r)
+	return rec
+}
+
+func newTestSessionHandler(t *testing.T) (*BaseHandler, int) {
+	t.Helper()
+	conn := openTestDB(t)
+	keys, err := NewEphemeralKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := db.CreateUser(conn, fmt.Sprintf("user-%d@example.com", time.Now().UnixNano()), "hash", "user",
+		db.ROLE_CUSTOMER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewBaseHandler(conn, keys, nil, nil, NewConfigFromEnv()), userID
+}
+
+func TestRefreshCookieCSRF(t *testing.T) {
+	h, userID := newTestSessionHandler(t)
+	suffix := time.Now().UnixNano()
+	refreshToken, csrfToken := fmt.Sprintf("refresh-%d", suffix), fmt.Sprintf("csrf-%d", suffix)
+	err := db.CreateRefreshToken(h.Conn, userID, fmt.Sprintf("session-%d", suffix), hashToken(refreshToken),
+		hashToken(csrfToken), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, header := range []string{"", "other csrf token"} {
+		if rec := refresh(h, refreshToken, header); rec.Code != http.StatusForbidden {
+			t.Errorf("csrf header %q: got %d, want %d", header, rec.Code, http.StatusForbidden)
+		}
+	}
+
+	// The refused attempts have neither rotated the token nor ended the session.
+	rec := refresh(h, refreshToken, csrfToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", rec.Code, http.StatusOK)
+	}
+	set := map[string]bool{}
+	for _, cookie := range rec.Result().Cookies() {
+		set[cookie.Name] = cookie.Value != "" && cookie.MaxAge >= 0
+	}
+	for _, name := range []string{COOKIE_NAME, REFRESH_COOKIE_NAME, CSRF_COOKIE_NAME} {
+		if !set[name] {
+			t.Errorf("cookie %s not set", name)
+		}
+	}
+}
+
+func TestRefreshCookieWithoutStoredCSRF(t *testing.T) {
+	h, userID := newTestSessionHandler(t)
+	suffix := time.Now().UnixNano()
+	refreshToken := fmt.Sprintf("refresh-%d", suffix)
+	_, err := h.Conn.Exec(`INSERT INTO refresh_tokens (user_id, session_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)`, userID, fmt.Sprintf("session-%d", suffix), hashToken(refreshToken),
+		time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := refresh(h, refreshToken, "any csrf token")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge >= 0 {
+			t.Errorf("cookie %s not cleared", cookie.Name)
+		}
+	}
+	if rec := refresh(h, refreshToken, "any csrf token"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("second attempt: got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestLogInPasswordTooLong(t *testing.T) {
+	h := NewBaseHandler(nil, nil, nil, nil, NewConfigFromEnv())
+	body := `{"email": "user@example.com", "password": "` + strings.Repeat("x", passwords.MAX_LENGTH_BYTES+1) + `"}`
+	rec := httptest.NewRecorder()
+	h.LogIn(rec, httptest.NewRequest("POST", "/login", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
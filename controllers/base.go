@@ -2,15 +2,28 @@ package controllers
 
 import (
 	"database/sql"
+	"db-queries/mailer"
+	"db-queries/oidc"
+	"db-queries/passwords"
 	"net/http"
 	"time"
 )
 
 type Requester struct {
-	Username    string
-	Email       string
-	IsStaff     bool
-	IsSuperuser bool
+	ID            int
+	Username      string
+	Email         string
+	Role          string
+	Permissions   []string
+	EmailVerified bool
+	SessionID     string
+	TokenID       string
+	Purpose       string
+	ApiKeyID      int
+	Scopes        []string
+	// ActorID is the admin acting on behalf of the user, 0 unless impersonating.
+	ActorID    int
+	ActorEmail string
 }
 type AuthenticatedRequest struct {
 	*http.Request
@@ -18,11 +31,19 @@ type AuthenticatedRequest struct {
 }
 
 type BaseHandler struct {
-	Conn *sql.DB
+	Conn      *sql.DB
+	Keys      *KeySet
+	Mailer    mailer.Mailer
+	Passwords *passwords.Policy
+	// OIDC is the provider for single sign-on, nil if not configured.
+	OIDC   *oidc.Provider
+	Config Config
+	access *accessCache
 }
 
-func NewBaseHandler(db *sql.DB) *BaseHandler {
-	return &BaseHandler{db}
+func NewBaseHandler(db *sql.DB, keys *KeySet, m mailer.Mailer, policy *passwords.Policy, config Config) *BaseHandler {
+	return &BaseHandler{Conn: db, Keys: keys, Mailer: m, Passwords: policy, Config: config,
+		access: newAccessCache(time.Duration(config.AccessCacheTTLSecs) * time.Second)}
 }
 
 func (h *BaseHandler) Pong(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"db-queries/env"
+	"net/http"
+	"strings"
+)
+
+// Config holds the settings of the handlers. NewConfigFromEnv reads them from the envvars, which
+// has to wait until main has loaded the .env file, so they are not package level variables.
+type Config struct {
+	// UnverifiedUsersPolicy is one of the UNVERIFIED_POLICY_* values.
+	UnverifiedUsersPolicy string
+	// PublicURL is where the service is reached at, the links in the emails are built off it.
+	PublicURL string
+
+	// The failed logins allowed before the account or the ip is locked out, for
+	// LoginLockoutMins, and the exponential backoff before that.
+	LoginMaxFailuresPerAccount int
+	LoginMaxFailuresPerIP      int
+	LoginLockoutMins           int
+	LoginBackoffBaseSecs       int
+	LoginBackoffMaxSecs        int
+	// TrustProxyHeaders is only to be turned on behind a proxy setting X-Forwarded-For.
+	TrustProxyHeaders bool
+
+	// MFARequiredForStaff makes the staff set up two-factor authentication before logging in.
+	MFARequiredForStaff bool
+	// MFAIssuer is the name the authenticator apps show the codes under.
+	MFAIssuer string
+
+	// AccessCacheTTLSecs bounds how long a deactivation takes to apply to the tokens already
+	// issued, when the service runs as more than one instance.
+	AccessCacheTTLSecs int
+
+	// CookieSecure should only be turned off for serving over plain http in development.
+	CookieSecure   bool
+	CookieSameSite http.SameSite
+	CookieDomain   string
+
+	// OIDCGroupRoleMap maps the groups in the ID token to roles, read from "group=role,group=role".
+	OIDCGroupRoleMap map[string]string
+	// OIDCPostLoginURL is where the browser is sent once logged in. If not set, the tokens are
+	// returned in the response body.
+	OIDCPostLoginURL string
+
+	PersonalTokenDefaultTTLDays int
+	PersonalTokenMaxTTLDays     int
+	PersonalTokensMaxPerUser    int
+
+	LoginEventsRetentionDays int
+	// LoginAlertsEnabled turns the emails about logins from new devices on for those not opted out.
+	LoginAlertsEnabled bool
+
+	// SupportedLocales are the locales the users can pick from. Every user starts with en.
+	SupportedLocales []string
+
+	// ExportTimeoutMins bounds how long an export may hold its database connection.
+	ExportTimeoutMins int
+}
+
+func NewConfigFromEnv() Config {
+	return Config{
+		UnverifiedUsersPolicy: env.Get("UNVERIFIED_USERS_POLICY", UNVERIFIED_POLICY_LIMITED),
+		PublicURL:             env.Get("PUBLIC_URL", "http://localhost:8089"),
+
+		LoginMaxFailuresPerAccount: env.Int("LOGIN_MAX_FAILURES_PER_ACCOUNT", 5),
+		LoginMaxFailuresPerIP:      env.Int("LOGIN_MAX_FAILURES_PER_IP", 50),
+		LoginLockoutMins:           env.Int("LOGIN_LOCKOUT_MINS", 15),
+		LoginBackoffBaseSecs:       env.Int("LOGIN_BACKOFF_BASE_SECS", 1),
+		LoginBackoffMaxSecs:        env.Int("LOGIN_BACKOFF_MAX_SECS", 60),
+		TrustProxyHeaders:          env.Get("TRUST_PROXY_HEADERS", "false") == "true",
+
+		MFARequiredForStaff: env.Get("MFA_REQUIRED_FOR_STAFF", "false") == "true",
+		MFAIssuer:           env.Get("MFA_ISSUER", "Customer Support"),
+
+		AccessCacheTTLSecs: env.Int("ACCESS_CACHE_TTL_SECS", 5),
+
+		CookieSecure:   env.Get("COOKIE_SECURE", "true") == "true",
+		CookieSameSite: cookieSameSite(env.Get("COOKIE_SAMESITE", "lax")),
+		CookieDomain:   env.Get("COOKIE_DOMAIN", ""),
+
+		OIDCGroupRoleMap: parseGroupRoleMap(env.Get("OIDC_GROUP_ROLE_MAP", "")),
+		OIDCPostLoginURL: env.Get("OIDC_POST_LOGIN_URL", ""),
+
+		PersonalTokenDefaultTTLDays: env.Int("PERSONAL_TOKEN_DEFAULT_TTL_DAYS", 90),
+		PersonalTokenMaxTTLDays:     env.Int("PERSONAL_TOKEN_MAX_TTL_DAYS", 365),
+		PersonalTokensMaxPerUser:    env.Int("PERSONAL_TOKENS_MAX_PER_USER", 20),
+
+		LoginEventsRetentionDays: env.Int("LOGIN_EVENTS_RETENTION_DAYS", 90),
+		LoginAlertsEnabled:       env.Get("LOGIN_ALERTS_ENABLED", "true") == "true",
+
+		SupportedLocales: parseLocales(env.Get("SUPPORTED_LOCALES", "en")),
+
+		ExportTimeoutMins: env.Int("EXPORT_TIMEOUT_MINS", 10),
+	}
+}
+
+func parseLocales(value string) []string {
+	var locales []string
+	for _, locale := range strings.Split(value, ",") {
+		if locale = strings.TrimSpace(locale); locale != "" {
+			locales = append(locales, locale)
+		}
+	}
+	return locales
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const CSRF_COOKIE_NAME = "csrf_token"
+const CSRF_HEADER_NAME = "X-CSRF-Token"
+
+func cookieSameSite(mode string) http.SameSite {
+	switch strings.ToLower(mode) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+func (h *BaseHandler) newCookie(name, value, path string, expires time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   h.Config.CookieDomain,
+		Expires:  expires,
+		Secure:   h.Config.CookieSecure,
+		HttpOnly: httpOnly,
+		SameSite: h.Config.CookieSameSite,
+	}
+}
+
+// expiredCookie tells the browser to drop the cookie. The attributes have to match
+// the ones the cookie has been set with.
+func (h *BaseHandler) expiredCookie(name, path string, httpOnly bool) *http.Cookie {
+	cookie := h.newCookie(name, "", path, time.Time{}, httpOnly)
+	cookie.MaxAge = -1
+	return cookie
+}
+
+// checkCSRF guards the requests authenticated with the cookie, which the browser attaches
+// to requests made by other sites as well. Anything but reading has to come with the csrf
+// token in the X-CSRF-Token header, which other sites cannot read from the csrf cookie.
+// The hash of the token is carried in the signed claims, so a csrf cookie planted by
+// someone else does not help either.
+func checkCSRF(w http.ResponseWriter, req *http.Request, claims *Claims) bool {
+	if safeMethod(req.Method) {
+		return true
+	}
+
+	token := req.Header.Get(CSRF_HEADER_NAME)
+	if token == "" || claims.CSRFHash == "" ||
+		subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(claims.CSRFHash)) != 1 {
+		http.Error(w, "CSRF token missing or invalid.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
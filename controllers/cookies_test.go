@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	claims := &Claims{CSRFHash: hashToken("csrf token")}
+	cases := []struct {
+		name   string
+		method string
+		header string
+		claims *Claims
+		ok     bool
+	}{
+		{"reading", "GET", "", claims, true},
+		{"options", "OPTIONS", "", claims, true},
+		{"matching token", "POST", "csrf token", claims, true},
+		{"matching token on delete", "DELETE", "csrf token", claims, true},
+		{"no token", "POST", "", claims, false},
+		{"wrong token", "PATCH", "other token", claims, false},
+		{"the hash itself", "POST", hashToken("csrf token"), claims, false},
+		{"claims without a hash", "POST", "csrf token", &Claims{}, false},
+		{"neither", "POST", "", &Claims{}, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/tickets", nil)
+		if c.header != "" {
+			r.Header.Set(CSRF_HEADER_NAME, c.header)
+		}
+		rec := httptest.NewRecorder()
+		if ok := checkCSRF(rec, r, c.claims); ok != c.ok {
+			t.Errorf("%s: got %v, want %v", c.name, ok, c.ok)
+		}
+		if !c.ok && rec.Code != http.StatusForbidden {
+			t.Errorf("%s: responded with %d, want %d", c.name, rec.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package controllers
+
+import (
+	"database/sql"
+	"db-queries/db"
+	"os"
+	"testing"
+)
+
+// openTestDB connects to the database named by TEST_DB_NAME, on the server of the DB_* envvars,
+// and skips the test if it is not set. The database is not cleaned up afterwards.
+func openTestDB(t *testing.T) *sql.DB {
+	name := os.Getenv("TEST_DB_NAME")
+	if name == "" {
+		t.Skip("TEST_DB_NAME not set")
+	}
+	dsn := db.NewDSNFromEnv()
+	dsn.DATABASE = name
+	conn, err := db.Initialize(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err = db.CreateRelations(conn); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"database/sql"
+	"db-queries/db"
+	"db-queries/passwords"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// EraseUser answers the erasure requests of the users: their personal data is replaced with a
+// tombstone identity while their tickets and messages are kept for the support history. Nobody
+// can erase themselves, and the staff can only be erased by the ones who manage roles.
+func (h *BaseHandler) EraseUser(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !authorize(w, authReq, db.PERM_USERS_ERASE) {
+		return
+	}
+
+	userId, _ := strconv.Atoi(id)
+	user, err := db.GetUserByID(h.Conn, userId)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+	if user.ID == authReq.user.ID {
+		http.Error(w, "Unable to erase own account.", http.StatusBadRequest)
+		return
+	}
+	if db.IsStaffRole(user.Role) && !authorize(w, authReq, db.PERM_USERS_ROLES) {
+		return
+	}
+
+	erasure, err := db.EraseUser(h.Conn, user.ID, passwords.NO_PASSWORD)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+	if err == db.ErrUserErased {
+		http.Error(w, "User has already been erased.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.access.forget(user.ID)
+	if err := db.ClearLoginThrottle(h.Conn, accountThrottleKey(erasure.Email)); err != nil {
+		log.Printf("Unable to clear the login throttle of erased user %d: %v", user.ID, err)
+	}
+	h.audit(authReq.user.ID, user.ID, db.AUDIT_USER_ERASE, erasure)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(erasure)
+}
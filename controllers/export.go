@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"db-queries/db"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var userExportRegex, _ = regexp.Compile("^/users/[0-9]+/export[/]?$")
+
+// Methods: GET; path: /me/export
+func (h *BaseHandler) MyExport(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if authReq.Method != "GET" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	h.writeExport(w, authReq.Request, authReq.user.ID)
+}
+
+// UserExport lets the staff answer the data access requests of the users.
+func (h *BaseHandler) UserExport(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !authorize(w, authReq, db.PERM_USERS_EXPORT) {
+		return
+	}
+
+	userId, _ := strconv.Atoi(id)
+	if _, err := db.GetUserByID(h.Conn, userId); err != nil {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+	h.audit(authReq.user.ID, userId, db.AUDIT_USER_EXPORT, struct{}{})
+	h.writeExport(w, authReq.Request, userId)
+}
+
+// writeExport responds with a zip archive of all the data of the user, one json file each for
+// the profile, the tickets, the messages and the login history. The rows are written as they
+// are read, so once the archive has started, an error can only cut it short: the client is
+// left with an archive that does not open, and the error is logged. One export of a user runs
+// at a time, and for at most ExportTimeoutMins, so that slow clients do not pile up connections.
+func (h *BaseHandler) writeExport(w http.ResponseWriter, r *http.Request, userID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(h.Config.ExportTimeoutMins)*time.Minute)
+	defer cancel()
+
+	export, err := db.BeginExport(ctx, h.Conn, userID)
+	if err == db.ErrExportUnderway {
+		http.Error(w, "An export of the user is already underway.", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	defer export.Close()
+
+	profile, err := export.Profile()
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("user-%d-export-%s.zip", userID, time.Now().UTC().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	archive := zip.NewWriter(w)
+	err = writeArchiveFile(archive, "profile.json", func(out io.Writer) error {
+		return json.NewEncoder(out).Encode(profile)
+	})
+	if err == nil {
+		err = writeArchiveFile(archive, "tickets.json", func(out io.Writer) error {
+			return writeJSONArray(out, func(encode func(interface{}) error) error {
+				return export.Tickets(func(t db.Ticket) error { return encode(t) })
+			})
+		})
+	}
+	if err == nil {
+		err = writeArchiveFile(archive, "messages.json", func(out io.Writer) error {
+			return writeJSONArray(out, func(encode func(interface{}) error) error {
+				return export.Messages(func(m db.ExportedMessage) error { return encode(m) })
+			})
+		})
+	}
+	if err == nil {
+		err = writeArchiveFile(archive, "login_events.json", func(out io.Writer) error {
+			return writeJSONArray(out, func(encode func(interface{}) error) error {
+				return export.LoginEvents(func(l db.LoginEvent) error { return encode(l) })
+			})
+		})
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		log.Printf("Export of user %d cut short: %v", userID, err)
+	}
+}
+
+func writeArchiveFile(archive *zip.Writer, name string, write func(io.Writer) error) error {
+	out, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	return write(out)
+}
+
+// writeJSONArray writes the values passed to encode as the elements of a json array, without
+// holding them all in memory.
+func writeJSONArray(out io.Writer, each func(encode func(interface{}) error) error) error {
+	if _, err := io.WriteString(out, "["); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	separator := "\n"
+	err := each(func(value interface{}) error {
+		if _, err := io.WriteString(out, separator); err != nil {
+			return err
+		}
+		separator = ","
+		return encoder.Encode(value)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, "]\n")
+	return err
+}
@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"db-queries/db"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const IMPERSONATION_TOKEN_TTL_MINS = 15
+
+type ImpersonationResponse struct {
+	AccessToken string    `json:"accessToken"`
+	TokenType   string    `json:"tokenType"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	UserID      int       `json:"userId"`
+}
+
+// ImpersonationAuditDetails is recorded for every request made with an impersonation token.
+type ImpersonationAuditDetails struct {
+	SessionID string `json:"sid"`
+	Method    string `json:"method,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Allowed   bool   `json:"allowed"`
+}
+
+func (r Requester) impersonated() bool {
+	return r.ActorID != 0
+}
+
+// ImpersonateUser issues the admin a short-lived token acting as the customer, so that the
+// API can be seen the way the customer sees it. The token is only returned in the response
+// body, leaving the admin's own session cookies alone, and is not refreshable.
+func (h *BaseHandler) ImpersonateUser(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !authorize(w, authReq, db.PERM_USERS_IMPERSONATE) {
+		return
+	}
+
+	userId, _ := strconv.Atoi(id)
+	user, err := db.GetUserByID(h.Conn, userId)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+	if db.IsStaffRole(user.Role) {
+		http.Error(w, "Only customers can be impersonated.", http.StatusForbidden)
+		return
+	}
+
+	sessionID, err := newTokenID()
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	ttl := time.Now().Add(IMPERSONATION_TOKEN_TTL_MINS * time.Minute)
+	actor := &Actor{Subject: strconv.Itoa(authReq.user.ID), Email: authReq.user.Email}
+	token, err := h.createTokenForUser(user, actor, sessionID, "", "", ttl)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	err = db.AddAuditRecord(h.Conn, authReq.user.ID, user.ID, db.AUDIT_IMPERSONATION_START,
+		ImpersonationAuditDetails{SessionID: sessionID, Allowed: true})
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ImpersonationResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresAt:   ttl,
+		UserID:      user.ID,
+	})
+}
+
+// auditImpersonatedRequest records the request made with an impersonation token and refuses
+// anything but reading: an impersonating admin may look, not act. If the request cannot be
+// recorded, it is not let through either.
+func (h *BaseHandler) auditImpersonatedRequest(w http.ResponseWriter, authReq *AuthenticatedRequest) bool {
+	readOnly := safeMethod(authReq.Method)
+
+	err := db.AddAuditRecord(h.Conn, authReq.user.ActorID, authReq.user.ID, db.AUDIT_IMPERSONATION_REQUEST,
+		ImpersonationAuditDetails{
+			SessionID: authReq.user.SessionID,
+			Method:    authReq.Method,
+			Path:      authReq.URL.RequestURI(),
+			Allowed:   readOnly,
+		})
+	if err != nil {
+		log.Printf("Unable to record impersonated request of user %d: %v", authReq.user.ActorID, err)
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return false
+	}
+
+	if !readOnly {
+		http.Error(w, "Not allowed while impersonating.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
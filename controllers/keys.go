@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const KEY_FILE_EXT = ".pem"
+
+var unknownKeyIdError = errors.New("Unknown key id")
+
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	signer crypto.Signer
+	public crypto.PublicKey
+}
+
+// KeySet holds the keys tokens are signed and verified with. Only the active key
+// signs; the rest are kept to verify tokens issued before the last rotation.
+type KeySet struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadKeySet reads every <kid>.pem file in dir. A file holds either a private key
+// (PKCS#1 or PKCS#8, RSA or Ed25519) or a PKIX public key. The key named by activeKid
+// must be a private one and is used for signing, all the others verify only.
+func LoadKeySet(dir, activeKid string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+KEY_FILE_EXT))
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{keys: make(map[string]*signingKey)}
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), KEY_FILE_EXT)
+		key, err := loadKeyFile(path, kid)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys[kid] = key
+	}
+
+	active, ok := ks.keys[activeKid]
+	if !ok {
+		return nil, fmt.Errorf("active key %q not found in %s", activeKid, dir)
+	}
+	if active.signer == nil {
+		return nil, fmt.Errorf("active key %q is not a private key", activeKid)
+	}
+	ks.active = active
+	return ks, nil
+}
+
+// NewEphemeralKeySet generates a single Ed25519 key living only as long as the process,
+// so every restart invalidates the tokens issued. Meant for development.
+func NewEphemeralKeySet() (*KeySet, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{kid, jwt.SigningMethodEdDSA, private, public}
+	return &KeySet{active: key, keys: map[string]*signingKey{kid: key}}, nil
+}
+
+func loadKeyFile(path, kid string) (*signingKey, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &signingKey{kid, jwt.SigningMethodRS256, k, k.Public()}, nil
+	case *rsa.PublicKey:
+		return &signingKey{kid, jwt.SigningMethodRS256, nil, k}, nil
+	case ed25519.PrivateKey:
+		return &signingKey{kid, jwt.SigningMethodEdDSA, k, k.Public()}, nil
+	case ed25519.PublicKey:
+		return &signingKey{kid, jwt.SigningMethodEdDSA, nil, k}, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported key type %T", path, parsed)
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.method, claims)
+	token.Header["kid"] = ks.active.kid
+	return token.SignedString(ks.active.signer)
+}
+
+// keyFunc picks the verification key by the token's kid and makes sure the token
+// is signed with the algorithm that key is meant for.
+func (ks *KeySet) keyFunc(tkn *jwt.Token) (interface{}, error) {
+	kid, _ := tkn.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, unknownKeyIdError
+	}
+	if tkn.Method.Alg() != key.method.Alg() {
+		return nil, wrongSigningMethodError
+	}
+	return key.public, nil
+}
+
+func (ks *KeySet) jwks() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for kid, key := range ks.keys {
+		jwk := JWK{Use: "sig", Alg: key.method.Alg(), Kid: kid}
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// Methods: GET; path: /.well-known/jwks.json
+func (h *BaseHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.Keys.jwks())
+}
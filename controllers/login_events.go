@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"db-queries/db"
+	"db-queries/mailer"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const LOGIN_EVENTS_DEFAULT_LIMIT = 50
+const LOGIN_EVENTS_MAX_LIMIT = 200
+const LOGIN_EVENT_USER_AGENT_MAX_LENGTH = 512
+const LOGIN_EVENTS_PURGE_INTERVAL = time.Hour
+
+var userLoginsRegex, _ = regexp.Compile("^/users/[0-9]+/logins[/]?$")
+
+// recordLogin records the attempt to log in as the email and tells whether to alert the user
+// of it. The login going on regardless, a failure to record it is only logged.
+func (h *BaseHandler) recordLogin(r *http.Request, email, method, outcome string) (alert bool) {
+	ip, userAgent := h.loginDevice(r)
+	alert, err := db.RecordLoginEvent(h.Conn, truncate(email, 255), ip, userAgent,
+		hashToken(ip+"\n"+userAgent), method, outcome)
+	if err != nil {
+		log.Printf("Unable to record %s login of %s: %v", outcome, email, err)
+	}
+	return alert
+}
+
+// PurgeLoginEvents deletes the login events kept for longer than LoginEventsRetentionDays
+// right away and then every LOGIN_EVENTS_PURGE_INTERVAL, for as long as the service runs.
+func (h *BaseHandler) PurgeLoginEvents() {
+	ticker := time.NewTicker(LOGIN_EVENTS_PURGE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		retainSince := time.Now().AddDate(0, 0, -h.Config.LoginEventsRetentionDays)
+		if purged, err := db.PurgeLoginEvents(h.Conn, retainSince); err != nil {
+			log.Printf("Unable to purge the login events: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d login events older than %d days.", purged, h.Config.LoginEventsRetentionDays)
+		}
+		<-ticker.C
+	}
+}
+
+// recordLoginSuccess records the login and lets the user know if it comes from a device they
+// have not logged in from before, unless they have opted out.
+func (h *BaseHandler) recordLoginSuccess(r *http.Request, user db.User, method string) {
+	if h.recordLogin(r, user.Email, method, db.LOGIN_SUCCESS) && h.Config.LoginAlertsEnabled {
+		h.sendNewDeviceEmail(user, r)
+	}
+}
+
+// loginDevice returns what tells the devices apart: the client ip and the user agent.
+func (h *BaseHandler) loginDevice(r *http.Request) (ip, userAgent string) {
+	return truncate(h.clientIP(r), 64), truncate(r.UserAgent(), LOGIN_EVENT_USER_AGENT_MAX_LENGTH)
+}
+
+func truncate(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	s = s[:maxBytes]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+func (h *BaseHandler) sendNewDeviceEmail(user db.User, r *http.Request) {
+	ip, userAgent := h.loginDevice(r)
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "New login to your account",
+		Body: fmt.Sprintf("Hi %s,\n\nYour account has just been logged into from a device we have not seen "+
+			"before:\n\nTime: %s\nIP address: %s\nBrowser: %s\n\nIf it was you, there is nothing to do. "+
+			"Otherwise, change your password right away and let us know.\n",
+			user.Username, time.Now().UTC().Format(time.RFC1123), ip, userAgent),
+	}
+	go func() {
+		if err := h.Mailer.Send(msg); err != nil {
+			log.Println("Failed to send new device email:", err)
+		}
+	}()
+}
+
+// Methods: GET; path: /me/logins
+func (h *BaseHandler) MyLogins(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if authReq.Method != "GET" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	h.writeLoginEvents(w, authReq, authReq.user.ID)
+}
+
+// UserLogins shows the staff the login history of the user.
+func (h *BaseHandler) UserLogins(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !authorize(w, authReq, db.PERM_USERS_LOGINS) {
+		return
+	}
+
+	userId, _ := strconv.Atoi(id)
+	if _, err := db.GetUserByID(h.Conn, userId); err != nil {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+	h.writeLoginEvents(w, authReq, userId)
+}
+
+// writeLoginEvents responds with the latest ?limit login attempts of the user.
+func (h *BaseHandler) writeLoginEvents(w http.ResponseWriter, authReq *AuthenticatedRequest, userID int) {
+	limit := LOGIN_EVENTS_DEFAULT_LIMIT
+	if value := strings.TrimSpace(authReq.URL.Query().Get("limit")); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > LOGIN_EVENTS_MAX_LIMIT {
+			http.Error(w, fmt.Sprintf("limit has to be between 1 and %d.", LOGIN_EVENTS_MAX_LIMIT), http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := db.GetLoginEventsOfUser(h.Conn, userID, limit)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(events)
+}
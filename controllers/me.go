@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"database/sql"
+	"db-queries/db"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+type EmailChangeDetails struct {
+	NewEmail string `json:"newEmail"`
+	Password string `json:"password"`
+}
+
+// Methods: GET/PATCH; path: /me
+func (h *BaseHandler) Me(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	switch authReq.Method {
+	case "GET":
+		h.GetProfile(w, authReq)
+	case "PATCH":
+		h.UpdateProfile(w, authReq)
+	default:
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// GetProfile shows the user their account, along with the numbers of their tickets.
+func (h *BaseHandler) GetProfile(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	h.writeProfile(w, authReq.user.ID)
+}
+
+// UpdateProfile changes the username, locale and notification preferences present in the payload.
+func (h *BaseHandler) UpdateProfile(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	var changes db.ProfileChanges
+	decoder := json.NewDecoder(authReq.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&changes); err != nil {
+		http.Error(w, "Invalid payload: only username, locale and notifications can be changed.", http.StatusBadRequest)
+		return
+	}
+
+	if changes.Username != nil && !validUsername(w, changes.Username) {
+		return
+	}
+	if changes.Locale != nil && !h.supportedLocale(*changes.Locale) {
+		http.Error(w, "Unsupported locale, expected one of: "+strings.Join(h.Config.SupportedLocales, ", "), http.StatusBadRequest)
+		return
+	}
+
+	if err := db.UpdateProfile(h.Conn, authReq.user.ID, changes); err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.writeProfile(w, authReq.user.ID)
+}
+
+// Methods: POST; path: /me/email
+// The email is only changed once the link sent to the new address has been followed, see VerifyEmail.
+// The password is asked for, since whoever controls the email can reset it.
+func (h *BaseHandler) ChangeEmail(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if authReq.Method != "POST" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var details EmailChangeDetails
+	err := json.NewDecoder(authReq.Body).Decode(&details)
+	if _, emailParseError := mail.ParseAddress(details.NewEmail); err != nil || emailParseError != nil ||
+		details.Password == "" {
+		http.Error(w, "Valid new email address and password required.", http.StatusBadRequest)
+		return
+	}
+
+	user, err := db.GetUserByID(h.Conn, authReq.user.ID)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	ip := h.clientIP(authReq.Request)
+	attempt, lockedFor, err := h.reserveLoginAttempt(user.Email, ip)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if lockedFor > 0 {
+		tooManyLoginAttempts(w, lockedFor)
+		return
+	}
+
+	_, err = h.verifyPassword(user.Email, details.Password)
+	if err == sql.ErrNoRows {
+		h.registerLoginFailure(user.Email, ip)
+		http.Error(w, "Password incorrect.", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		h.releaseLoginAttempt(attempt)
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.registerLoginSuccess(user.Email)
+	h.releaseLoginAttempt(attempt)
+
+	if strings.EqualFold(details.NewEmail, user.Email) {
+		http.Error(w, "New email address must differ from the current one.", http.StatusBadRequest)
+		return
+	}
+	if len(details.NewEmail) > 64 {
+		http.Error(w, "Email address too long.", http.StatusBadRequest)
+		return
+	}
+	_, err = db.GetUserByEmail(h.Conn, details.NewEmail)
+	if err == nil {
+		http.Error(w, "User with specified email already exists.", http.StatusBadRequest)
+		return
+	}
+	if err != sql.ErrNoRows {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.sendEmailChangeToken(user, details.NewEmail); err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *BaseHandler) writeProfile(w http.ResponseWriter, userID int) {
+	profile, err := db.GetProfile(h.Conn, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
+
+func (h *BaseHandler) supportedLocale(locale string) bool {
+	for _, supported := range h.Config.SupportedLocales {
+		if supported == locale {
+			return true
+		}
+	}
+	return false
+}
@@ -7,7 +7,13 @@ import (
 )
 
 func (h *BaseHandler) GetMessagesForTicket(ticketId string, res http.ResponseWriter, authReq *AuthenticatedRequest) {
-	msgs, err := db.GetMessagesForTicket(h.Conn, ticketId)
+	if !requireScope(res, authReq, SCOPE_TICKETS_READ) ||
+		!authorize(res, authReq, db.PERM_TICKETS_READ_OWN, db.PERM_TICKETS_READ_ANY) {
+		return
+	}
+
+	readAny := authReq.user.can(db.PERM_TICKETS_READ_ANY)
+	msgs, err := db.GetMessagesForTicket(h.Conn, ticketId, authReq.user.ID, readAny)
 	if err != nil || msgs == nil {
 		http.Error(res, "No messages found.", http.StatusNotFound)
 		return
@@ -17,6 +23,11 @@ func (h *BaseHandler) GetMessagesForTicket(ticketId string, res http.ResponseWri
 }
 
 func (h *BaseHandler) CreateMessage(ticketID string, res http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !requireScope(res, authReq, SCOPE_MESSAGES_WRITE) || !h.requireVerifiedEmail(res, authReq) ||
+		!authorize(res, authReq, db.PERM_MESSAGES_WRITE_OWN, db.PERM_MESSAGES_WRITE_ANY) {
+		return
+	}
+
 	var details TicketDetails
 	err := json.NewDecoder(authReq.Body).Decode(&details)
 	if err != nil || details.Text == "" {
@@ -24,12 +35,13 @@ func (h *BaseHandler) CreateMessage(ticketID string, res http.ResponseWriter, au
 		return
 	}
 
+	writeAny := authReq.user.can(db.PERM_MESSAGES_WRITE_ANY)
 	msgType := "request"
-	if authReq.user.IsStaff || authReq.user.IsSuperuser {
+	if writeAny {
 		msgType = "response"
 	}
 
-	if !db.AddMessage(h.Conn, msgType, authReq.user.Email, ticketID, details.Text) {
+	if !db.AddMessage(h.Conn, msgType, authReq.user.ID, ticketID, details.Text, writeAny) {
 		http.Error(res, "Ticket does not exist or does not belong to this user.", http.StatusNotFound)
 		return
 	}
@@ -0,0 +1,304 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"db-queries/db"
+	"db-queries/totp"
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const MFA_TOKEN_TTL_MINS = 10
+const RECOVERY_CODES_COUNT = 10
+
+const (
+	// The password has been checked, the one-time code is yet to be.
+	PURPOSE_MFA = "mfa"
+	// The password has been checked, but the user has to set up two-factor authentication first.
+	PURPOSE_MFA_ENROLL = "mfa_enroll"
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type MFAChallengeResponse struct {
+	MFARequired           bool      `json:"mfaRequired,omitempty"`
+	MFAEnrollmentRequired bool      `json:"mfaEnrollmentRequired,omitempty"`
+	MFAToken              string    `json:"mfaToken"`
+	ExpiresAt             time.Time `json:"expiresAt"`
+}
+type MFADetails struct {
+	MFAToken     string `json:"mfaToken"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+	ReturnToken  bool   `json:"returnToken"`
+}
+type TotpEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauthUri"`
+}
+type TotpConfirmationResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+	*TokenResponse
+}
+
+// requireSecondFactor responds to a login with valid credentials with a short-lived token
+// that can only be used to complete the login with a one-time code, or, if the user has
+// not set up two-factor authentication yet, to enroll.
+func (h *BaseHandler) requireSecondFactor(w http.ResponseWriter, user db.User, sessionID string) {
+	purpose := PURPOSE_MFA
+	if !user.TotpEnabled {
+		purpose = PURPOSE_MFA_ENROLL
+	}
+
+	ttl := time.Now().Add(MFA_TOKEN_TTL_MINS * time.Minute)
+	token, err := h.createTokenForUser(user, nil, sessionID, purpose, "", ttl)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(MFAChallengeResponse{
+		MFARequired:           user.TotpEnabled,
+		MFAEnrollmentRequired: !user.TotpEnabled,
+		MFAToken:              token,
+		ExpiresAt:             ttl,
+	})
+}
+
+// Methods: POST; path: /login/mfa
+func (h *BaseHandler) LogInMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var details MFADetails
+	err := json.NewDecoder(r.Body).Decode(&details)
+	if err != nil || details.MFAToken == "" || (details.Code == "" && details.RecoveryCode == "") {
+		http.Error(w, "MFA token and either code or recovery code required.", http.StatusBadRequest)
+		return
+	}
+
+	claims, userID, ok := h.validateToken(w, details.MFAToken, PURPOSE_MFA)
+	if !ok {
+		return
+	}
+
+	ip := h.clientIP(r)
+	attempt, lockedFor, err := h.reserveLoginAttempt(claims.Email, ip)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if lockedFor > 0 {
+		h.recordLogin(r, claims.Email, db.LOGIN_METHOD_MFA, db.LOGIN_LOCKED)
+		tooManyLoginAttempts(w, lockedFor)
+		return
+	}
+
+	if !h.checkSecondFactor(userID, details.Code, details.RecoveryCode) {
+		h.registerLoginFailure(claims.Email, ip)
+		h.recordLogin(r, claims.Email, db.LOGIN_METHOD_MFA, db.LOGIN_INVALID_CODE)
+		http.Error(w, "Invalid code.", http.StatusUnauthorized)
+		return
+	}
+	h.registerLoginSuccess(claims.Email)
+	h.releaseLoginAttempt(attempt)
+
+	user, err := db.GetUserByID(h.Conn, userID)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusUnauthorized)
+		return
+	}
+
+	if err := db.RevokeTokenID(h.Conn, claims.ID, claims.ExpiresAt.Time); err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := h.startSession(w, user, claims.SessionID)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.recordLoginSuccess(r, user, db.LOGIN_METHOD_MFA)
+	if details.ReturnToken {
+		writeTokenResponse(w, tokens)
+	}
+}
+
+// checkSecondFactor accepts either a totp code not used before or an unused recovery code.
+func (h *BaseHandler) checkSecondFactor(userID int, code, recoveryCode string) bool {
+	if code != "" {
+		secret, enabled, err := db.GetTotp(h.Conn, userID)
+		if err != nil || !enabled {
+			return false
+		}
+		step, ok := totp.Validate(secret, code, time.Now())
+		return ok && db.UseTotpStep(h.Conn, userID, step)
+	}
+	return db.UseRecoveryCode(h.Conn, userID, hashToken(normalizeRecoveryCode(recoveryCode)))
+}
+
+// Methods: POST; path: /me/2fa/enroll
+func (h *BaseHandler) EnrollTotp(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if authReq.Method != "POST" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	err = db.SetPendingTotpSecret(h.Conn, authReq.user.ID, secret)
+	if err == db.ErrTotpAlreadyEnabled {
+		http.Error(w, "Two-factor authentication already enabled.", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TotpEnrollmentResponse{
+		Secret: secret,
+		URI:    totp.URI(h.Config.MFAIssuer, authReq.user.Email, secret),
+	})
+}
+
+// Methods: POST; path: /me/2fa/confirm
+// When enrolling during login, a session is started on success, as if the login
+// had been completed with a code.
+func (h *BaseHandler) ConfirmTotp(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if authReq.Method != "POST" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var details MFADetails
+	err := json.NewDecoder(authReq.Body).Decode(&details)
+	if err != nil || details.Code == "" {
+		http.Error(w, "Code expected.", http.StatusBadRequest)
+		return
+	}
+
+	secret, enabled, err := db.GetTotp(h.Conn, authReq.user.ID)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication already enabled.", http.StatusBadRequest)
+		return
+	}
+	if secret == "" {
+		http.Error(w, "Enrollment not started.", http.StatusBadRequest)
+		return
+	}
+
+	step, ok := totp.Validate(secret, details.Code, time.Now())
+	if !ok {
+		http.Error(w, "Invalid code.", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	err = db.EnableTotp(h.Conn, authReq.user.ID, step, hashes)
+	if err == db.ErrTotpAlreadyEnabled {
+		http.Error(w, "Two-factor authentication already enabled.", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	resp := TotpConfirmationResponse{RecoveryCodes: codes}
+	if authReq.user.Purpose == PURPOSE_MFA_ENROLL {
+		user, err := db.GetUserByID(h.Conn, authReq.user.ID)
+		if err != nil {
+			http.Error(w, "Please try again later.", http.StatusInternalServerError)
+			return
+		}
+
+		until := time.Now().Add(MFA_TOKEN_TTL_MINS * time.Minute)
+		if err := db.RevokeTokenID(h.Conn, authReq.user.TokenID, until); err != nil {
+			http.Error(w, "Please try again later.", http.StatusInternalServerError)
+			return
+		}
+
+		tokens, err := h.startSession(w, user, authReq.user.SessionID)
+		if err != nil {
+			http.Error(w, "Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		h.recordLoginSuccess(authReq.Request, user, db.LOGIN_METHOD_MFA)
+		resp.TokenResponse = &tokens
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Methods: POST; path: /me/2fa/disable
+func (h *BaseHandler) DisableTotp(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if authReq.Method != "POST" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.Config.MFARequiredForStaff && db.IsStaffRole(authReq.user.Role) {
+		http.Error(w, "Two-factor authentication is mandatory for staff.", http.StatusForbidden)
+		return
+	}
+
+	var details MFADetails
+	err := json.NewDecoder(authReq.Body).Decode(&details)
+	if err != nil || (details.Code == "" && details.RecoveryCode == "") {
+		http.Error(w, "Code or recovery code expected.", http.StatusBadRequest)
+		return
+	}
+
+	if !h.checkSecondFactor(authReq.user.ID, details.Code, details.RecoveryCode) {
+		http.Error(w, "Invalid code.", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DisableTotp(h.Conn, authReq.user.ID); err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+}
+
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < RECOVERY_CODES_COUNT; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -1,48 +1,203 @@
 package controllers
 
 import (
+	"db-queries/db"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/golang-jwt/jwt/v4"
 )
 
-var wrongSigningMethodError = errors.New("Unexpected signing method")
+var (
+	wrongSigningMethodError = errors.New("Unexpected signing method")
+	wrongAuthHeaderError    = errors.New("Token of wrong format.")
+)
+
+// bearerToken extracts the token from the 'Authorization: Bearer <token>' header.
+// present reports whether the header has been sent at all.
+func bearerToken(req *http.Request) (token string, present bool, err error) {
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return "", false, nil
+	}
+
+	parts := strings.Fields(header)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", true, wrongAuthHeaderError
+	}
+	return parts[1], true, nil
+}
+
+// requestToken returns the jwt sent with the request. The Authorization header takes
+// precedence over the cookie: once the header is present, the cookie is not looked at,
+// even if the header turns out to be malformed.
+func requestToken(req *http.Request) (token string, fromCookie bool, err error) {
+	token, present, err := bearerToken(req)
+	if present {
+		return token, false, err
+	}
+
+	cookie, errorNoCookie := req.Cookie(COOKIE_NAME)
+	if errorNoCookie != nil {
+		return "", false, errorNoCookie
+	}
+	return cookie.Value, true, nil
+}
+
+// safeMethod tells the requests that only read.
+func safeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+func (h *BaseHandler) JWTMiddleWare(next func(res http.ResponseWriter, req *AuthenticatedRequest)) http.Handler {
+	return h.authenticate(next, false, "")
+}
 
-func JWTMiddleWare(next func(res http.ResponseWriter, req *AuthenticatedRequest)) http.Handler {
+// JWTOrApiKeyMiddleWare also accepts API keys in the Authorization header. The handlers behind
+// it have to check the scopes of the request with requireScope.
+func (h *BaseHandler) JWTOrApiKeyMiddleWare(next func(res http.ResponseWriter, req *AuthenticatedRequest)) http.Handler {
+	return h.authenticate(next, true, "")
+}
+
+// MFAEnrollMiddleWare also lets through the token issued to users who have to set up
+// two-factor authentication before they are let in.
+func (h *BaseHandler) MFAEnrollMiddleWare(next func(res http.ResponseWriter, req *AuthenticatedRequest)) http.Handler {
+	return h.authenticate(next, false, "", PURPOSE_MFA_ENROLL)
+}
+
+func (h *BaseHandler) authenticate(next func(res http.ResponseWriter, req *AuthenticatedRequest),
+	allowApiKeys bool, purposes ...string) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		tokenString, errorNoCookie := req.Cookie(COOKIE_NAME)
-		if errorNoCookie != nil {
-			http.Error(res, "Token missing in 'Cookie' headers.", http.StatusUnauthorized)
+		tokenString, fromCookie, err := requestToken(req)
+		if err == wrongAuthHeaderError {
+			http.Error(res, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(res, "Token missing in 'Authorization' or 'Cookie' headers.", http.StatusUnauthorized)
 			return
 		}
 
-		claims := &Claims{}
-		_, validErr := jwt.ParseWithClaims(tokenString.Value, claims,
-			func(tkn *jwt.Token) (interface{}, error) {
-				if _, ok := tkn.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, wrongSigningMethodError
-				}
-				return JWT_KEY, nil
-			})
-
-		if validErr != nil {
-			msg := "Token invalid."
-			errParsed, _ := validErr.(*jwt.ValidationError)
-			if errParsed.Errors == jwt.ValidationErrorExpired {
-				msg = "Token expired."
+		if strings.HasPrefix(tokenString, API_KEY_PREFIX) {
+			if !allowApiKeys {
+				http.Error(res, "API keys are not accepted by this endpoint.", http.StatusUnauthorized)
+				return
+			}
+			requester, ok := h.authenticateApiKey(res, tokenString)
+			if !ok {
+				return
 			}
-			http.Error(res, msg, http.StatusUnauthorized)
+			next(res, &AuthenticatedRequest{req, requester})
+			return
+		}
+
+		claims, userID, ok := h.validateToken(res, tokenString, purposes...)
+		if !ok {
 			return
 		}
+		if fromCookie && !checkCSRF(res, req, claims) {
+			return
+		}
+
+		requester := Requester{
+			ID:            userID,
+			Role:          claims.Role,
+			Permissions:   claims.Permissions,
+			EmailVerified: claims.EmailVerified,
+			Email:         claims.Email,
+			Username:      claims.Username,
+			SessionID:     claims.SessionID,
+			TokenID:       claims.ID,
+			Purpose:       claims.Purpose,
+		}
+		if claims.Actor != nil {
+			requester.ActorID, _ = strconv.Atoi(claims.Actor.Subject)
+			requester.ActorEmail = claims.Actor.Email
+		}
 
-		enrichedReruest := &AuthenticatedRequest{req, Requester{
-			IsStaff:     claims.IsStaff,
-			IsSuperuser: claims.IsSuperuser,
-			Email:       claims.Email,
-			Username:    claims.Username,
-		},
+		enrichedReruest := &AuthenticatedRequest{req, requester}
+		if requester.impersonated() && !h.auditImpersonatedRequest(res, enrichedReruest) {
+			return
 		}
 		next(res, enrichedReruest)
 	})
 }
+
+// validateToken checks the token's signature, expiry, revocation and purpose. If the token
+// cannot be accepted, the error is written to res and ok is false.
+func (h *BaseHandler) validateToken(res http.ResponseWriter, tokenString string, purposes ...string) (claims *Claims, userID int, ok bool) {
+	claims = &Claims{}
+	_, validErr := jwt.ParseWithClaims(tokenString, claims, h.Keys.keyFunc)
+
+	if validErr != nil {
+		msg := "Token invalid."
+		errParsed, _ := validErr.(*jwt.ValidationError)
+		if errParsed.Errors == jwt.ValidationErrorExpired {
+			msg = "Token expired."
+		}
+		http.Error(res, msg, http.StatusUnauthorized)
+		return nil, 0, false
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || claims.ID == "" || claims.SessionID == "" || claims.IssuedAt == nil ||
+		(claims.Actor != nil && claims.Actor.Subject == "") {
+		http.Error(res, "Token invalid.", http.StatusUnauthorized)
+		return nil, 0, false
+	}
+
+	purposeAllowed := false
+	for _, purpose := range purposes {
+		purposeAllowed = purposeAllowed || claims.Purpose == purpose
+	}
+	if !purposeAllowed {
+		http.Error(res, "Token invalid.", http.StatusUnauthorized)
+		return nil, 0, false
+	}
+
+	revoked, err := db.IsTokenRevoked(h.Conn, claims.ID, claims.SessionID)
+	if err != nil {
+		http.Error(res, "Please try again later.", http.StatusInternalServerError)
+		return nil, 0, false
+	}
+	if revoked {
+		http.Error(res, "Token revoked.", http.StatusUnauthorized)
+		return nil, 0, false
+	}
+
+	if !h.tokenHolderActive(res, userID, claims) {
+		return nil, 0, false
+	}
+
+	if !claims.EmailVerified && h.Config.UnverifiedUsersPolicy == UNVERIFIED_POLICY_BLOCK {
+		http.Error(res, "Email address not verified.", http.StatusForbidden)
+		return nil, 0, false
+	}
+
+	return claims, userID, true
+}
+
+// tokenHolderActive rejects the tokens of deactivated users, as well as the ones issued before
+// the last deactivation. The same applies to the admin behind an impersonation token.
+func (h *BaseHandler) tokenHolderActive(res http.ResponseWriter, userID int, claims *Claims) bool {
+	holders := []int{userID}
+	if claims.Actor != nil {
+		actorID, _ := strconv.Atoi(claims.Actor.Subject)
+		holders = append(holders, actorID)
+	}
+
+	for _, id := range holders {
+		access, err := h.access.get(h.Conn, id)
+		if err != nil {
+			http.Error(res, "Please try again later.", http.StatusInternalServerError)
+			return false
+		}
+		if !access.accepts(claims.IssuedAt.Time) {
+			http.Error(res, "Token revoked.", http.StatusUnauthorized)
+			return false
+		}
+	}
+	return true
+}
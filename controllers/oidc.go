@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"db-queries/db"
+	"db-queries/env"
+	"db-queries/oidc"
+	"db-queries/passwords"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const OIDC_STATE_COOKIE_NAME = "oidc_state"
+const OIDC_STATE_COOKIE_PATH = "/auth/oidc"
+const OIDC_STATE_TTL_MINS = 10
+const OIDC_STATE_AUDIENCE = "oidc_state"
+
+// The single sign-on is for the staff, the most privileged role of the user's groups wins.
+var oidcRolePrecedence = []string{db.ROLE_ADMIN, db.ROLE_SUPERVISOR, db.ROLE_AGENT}
+
+// OIDCStateClaims keep the values of the login started at the provider until it comes back
+// to the callback, in a signed cookie.
+type OIDCStateClaims struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"codeVerifier"`
+	jwt.RegisteredClaims
+}
+
+// NewOIDCProviderFromEnv discovers the provider set with the OIDC_* envvars, nil if
+// single sign-on is not configured. The callback is under publicURL unless
+// OIDC_REDIRECT_URL says otherwise.
+func NewOIDCProviderFromEnv(publicURL string) (*oidc.Provider, error) {
+	issuer := env.Get("OIDC_ISSUER", "")
+	if issuer == "" {
+		return nil, nil
+	}
+	log.Println("Discovering OIDC provider.")
+	return oidc.Discover(issuer, env.Get("OIDC_CLIENT_ID", ""), env.Get("OIDC_CLIENT_SECRET", ""),
+		env.Get("OIDC_REDIRECT_URL", publicURL+"/auth/oidc/callback"),
+		strings.Fields(env.Get("OIDC_SCOPES", "openid email profile")))
+}
+
+func parseGroupRoleMap(value string) map[string]string {
+	groupRoles := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !db.VALID_ROLES[strings.TrimSpace(parts[1])] {
+			log.Printf("WARNING. Skipping invalid OIDC_GROUP_ROLE_MAP entry %q.", pair)
+			continue
+		}
+		groupRoles[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return groupRoles
+}
+
+// roleFromGroups maps the groups of the user to the role they get, "" if none.
+func roleFromGroups(groupRoles map[string]string, groups []string) string {
+	granted := map[string]bool{}
+	for _, group := range groups {
+		granted[groupRoles[group]] = true
+	}
+	for _, role := range oidcRolePrecedence {
+		if granted[role] {
+			return role
+		}
+	}
+	return ""
+}
+
+// Methods: GET; path: /auth/oidc/login
+// Sends the browser to log in at the provider.
+func (h *BaseHandler) OIDCLogIn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.OIDC == nil {
+		http.Error(w, "Single sign-on not configured.", http.StatusNotFound)
+		return
+	}
+
+	var state OIDCStateClaims
+	var err error
+	for _, value := range []*string{&state.State, &state.Nonce, &state.CodeVerifier} {
+		if *value, err = oidc.NewCodeVerifier(); err != nil {
+			http.Error(w, "Please try again later.", http.StatusInternalServerError)
+			return
+		}
+	}
+	ttl := time.Now().Add(OIDC_STATE_TTL_MINS * time.Minute)
+	state.RegisteredClaims = jwt.RegisteredClaims{
+		Audience:  jwt.ClaimStrings{OIDC_STATE_AUDIENCE},
+		ExpiresAt: jwt.NewNumericDate(ttl),
+	}
+
+	cookieValue, err := h.Keys.sign(state)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	// The provider redirects back with a top-level navigation, which only takes Lax cookies along.
+	cookie := h.newCookie(OIDC_STATE_COOKIE_NAME, cookieValue, OIDC_STATE_COOKIE_PATH, ttl, true)
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, h.OIDC.AuthCodeURL(state.State, state.Nonce, state.CodeVerifier), http.StatusFound)
+}
+
+// Methods: GET; path: /auth/oidc/callback
+// Completes the login started by OIDCLogIn: the user is provisioned or updated from the ID token
+// and a session is started just like with a password login. Two-factor authentication is left
+// to the provider.
+func (h *BaseHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.OIDC == nil {
+		http.Error(w, "Single sign-on not configured.", http.StatusNotFound)
+		return
+	}
+
+	state, ok := h.oidcState(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		http.Error(w, "Login at the identity provider failed: "+query.Get("error"), http.StatusUnauthorized)
+		return
+	}
+	if query.Get("code") == "" {
+		http.Error(w, "Authorization code missing.", http.StatusBadRequest)
+		return
+	}
+
+	identity, err := h.OIDC.Exchange(query.Get("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		http.Error(w, "Login at the identity provider failed.", http.StatusUnauthorized)
+		return
+	}
+	if identity.Email == "" || (identity.EmailVerified != nil && !*identity.EmailVerified) {
+		http.Error(w, "Verified email address required from the identity provider.", http.StatusForbidden)
+		return
+	}
+
+	role := roleFromGroups(h.Config.OIDCGroupRoleMap, identity.Groups)
+	if role == "" {
+		demotedID, err := db.DemoteOIDCUser(h.Conn, identity.Issuer, identity.Subject)
+		if err != nil {
+			http.Error(w, "Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		if demotedID != 0 {
+			h.access.forget(demotedID)
+		}
+		h.recordLogin(r, identity.Email, db.LOGIN_METHOD_OIDC, db.LOGIN_NO_ROLE)
+		http.Error(w, "No role granted by the identity provider.", http.StatusForbidden)
+		return
+	}
+
+	user, err := h.provisionOIDCUser(identity, role)
+	if err == db.ErrOIDCIdentityConflict {
+		http.Error(w, "The account of the email cannot be linked to the identity.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.access.forget(user.ID)
+	if !user.Active {
+		h.recordLogin(r, user.Email, db.LOGIN_METHOD_OIDC, db.LOGIN_DEACTIVATED)
+		http.Error(w, "Account deactivated.", http.StatusForbidden)
+		return
+	}
+
+	sessionID, err := newTokenID()
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	tokens, err := h.startSession(w, user, sessionID)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.recordLoginSuccess(r, user, db.LOGIN_METHOD_OIDC)
+
+	if h.Config.OIDCPostLoginURL != "" {
+		http.Redirect(w, r, h.Config.OIDCPostLoginURL, http.StatusFound)
+		return
+	}
+	writeTokenResponse(w, tokens)
+}
+
+// oidcState reads the state cookie set by OIDCLogIn, makes sure it has been issued by us for
+// the login coming back, and drops it, so it cannot be used twice.
+func (h *BaseHandler) oidcState(w http.ResponseWriter, r *http.Request) (*OIDCStateClaims, bool) {
+	cookie, errorNoCookie := r.Cookie(OIDC_STATE_COOKIE_NAME)
+	http.SetCookie(w, h.expiredCookie(OIDC_STATE_COOKIE_NAME, OIDC_STATE_COOKIE_PATH, true))
+	if errorNoCookie != nil {
+		http.Error(w, "Login state missing, please start over.", http.StatusBadRequest)
+		return nil, false
+	}
+
+	state := &OIDCStateClaims{}
+	_, err := jwt.ParseWithClaims(cookie.Value, state, h.Keys.keyFunc)
+	if err != nil || !state.VerifyAudience(OIDC_STATE_AUDIENCE, true) ||
+		subtle.ConstantTimeCompare([]byte(state.State), []byte(r.URL.Query().Get("state"))) != 1 {
+		http.Error(w, "Login state invalid, please start over.", http.StatusBadRequest)
+		return nil, false
+	}
+	return state, true
+}
+
+func (h *BaseHandler) provisionOIDCUser(identity *oidc.IDTokenClaims, role string) (db.User, error) {
+	username := identity.PreferredUsername
+	if username == "" {
+		username = identity.Name
+	}
+	if username == "" {
+		username = strings.Split(identity.Email, "@")[0]
+	}
+	if len(username) > 64 {
+		username = username[:64]
+	}
+
+	// The accounts created or linked here have no password.
+	return db.ProvisionOIDCUser(h.Conn, identity.Issuer, identity.Subject, identity.Email, username, role,
+		passwords.NO_PASSWORD)
+}
@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"db-queries/db"
+	"db-queries/oidc"
+	"db-queries/oidc/mockidp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func newOIDCHandler(t *testing.T) *BaseHandler {
+	t.Helper()
+	idp, err := mockidp.New("", "ticket-service", "secret", "agent@corp.io", "support-agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(idp.Handler())
+	t.Cleanup(srv.Close)
+	idp.Issuer = srv.URL
+
+	provider, err := oidc.Discover(srv.URL, "ticket-service", "secret", "http://service.test/auth/oidc/callback",
+		[]string{"openid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewEphemeralKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewBaseHandler(nil, keys, nil, nil, NewConfigFromEnv())
+	h.OIDC = provider
+	return h
+}
+
+// startOIDCLogin runs GET /auth/oidc/login and the login at the provider, and returns the state
+// cookie along with the query the provider redirects back with.
+func startOIDCLogin(t *testing.T, h *BaseHandler) (*http.Cookie, url.Values) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.OIDCLogIn(rec, httptest.NewRequest("GET", "/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login responded with %d", rec.Code)
+	}
+
+	var stateCookie *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == OIDC_STATE_COOKIE_NAME {
+			stateCookie = cookie
+		}
+	}
+	if stateCookie == nil || stateCookie.SameSite != http.SameSiteLaxMode || !stateCookie.HttpOnly {
+		t.Fatalf("state cookie %+v, want an HttpOnly Lax one", stateCookie)
+	}
+
+	authURL, _ := url.Parse(rec.Header().Get("Location"))
+	if authURL.Query().Get("code_challenge_method") != "S256" || authURL.Query().Get("nonce") == "" {
+		t.Fatalf("authorization url %s without PKCE or nonce", authURL)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(authURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	callback, _ := url.Parse(res.Header.Get("Location"))
+	return stateCookie, callback.Query()
+}
+
+func callOIDCCallback(h *BaseHandler, stateCookie *http.Cookie, query url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/auth/oidc/callback?"+query.Encode(), nil)
+	if stateCookie != nil {
+		req.AddCookie(stateCookie)
+	}
+	rec := httptest.NewRecorder()
+	h.OIDCCallback(rec, req)
+	return rec
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	h := newOIDCHandler(t)
+	_, callback := startOIDCLogin(t, h)
+
+	if rec := callOIDCCallback(h, nil, callback); rec.Code != http.StatusBadRequest {
+		t.Errorf("got %d without the state cookie, want 400", rec.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsStateOfAnotherLogin(t *testing.T) {
+	h := newOIDCHandler(t)
+	stateCookie, _ := startOIDCLogin(t, h)
+	_, otherCallback := startOIDCLogin(t, h)
+
+	if rec := callOIDCCallback(h, stateCookie, otherCallback); rec.Code != http.StatusBadRequest {
+		t.Errorf("got %d for the state of another login, want 400", rec.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsForgedStateCookie(t *testing.T) {
+	h := newOIDCHandler(t)
+	stateCookie, callback := startOIDCLogin(t, h)
+
+	// The state is right, but the cookie has been signed by somebody else.
+	otherKeys, err := NewEphemeralKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := otherKeys.sign(OIDCStateClaims{
+		State: callback.Get("state"),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{OIDC_STATE_AUDIENCE},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateCookie.Value = forged
+
+	if rec := callOIDCCallback(h, stateCookie, callback); rec.Code != http.StatusBadRequest {
+		t.Errorf("got %d for a forged state cookie, want 400", rec.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsCodeOfAnotherLogin(t *testing.T) {
+	h := newOIDCHandler(t)
+	stateCookie, callback := startOIDCLogin(t, h)
+	_, otherCallback := startOIDCLogin(t, h)
+
+	// The state matches, the code was issued for another code verifier and nonce.
+	callback.Set("code", otherCallback.Get("code"))
+	if rec := callOIDCCallback(h, stateCookie, callback); rec.Code != http.StatusUnauthorized {
+		t.Errorf("got %d for the code of another login, want 401", rec.Code)
+	}
+}
+
+func TestOIDCCallbackProviderError(t *testing.T) {
+	h := newOIDCHandler(t)
+	stateCookie, callback := startOIDCLogin(t, h)
+	callback.Del("code")
+	callback.Set("error", "access_denied")
+
+	if rec := callOIDCCallback(h, stateCookie, callback); rec.Code != http.StatusUnauthorized {
+		t.Errorf("got %d for an error at the provider, want 401", rec.Code)
+	}
+}
+
+func TestRoleFromGroups(t *testing.T) {
+	groupRoles := parseGroupRoleMap("support=agent, leads=supervisor,it=admin,bogus=root")
+
+	cases := []struct {
+		groups []string
+		role   string
+	}{
+		{nil, ""},
+		{[]string{"marketing"}, ""},
+		{[]string{"bogus"}, ""},
+		{[]string{"support"}, db.ROLE_AGENT},
+		{[]string{"support", "leads"}, db.ROLE_SUPERVISOR},
+		{[]string{"it", "support"}, db.ROLE_ADMIN},
+	}
+	for _, c := range cases {
+		if role := roleFromGroups(groupRoles, c.groups); role != c.role {
+			t.Errorf("roleFromGroups(%v) = %q, want %q", c.groups, role, c.role)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const DEFAULT_PAGE_SIZE = 20
+const MAX_PAGE_SIZE = 100
+
+// Page describes the part of a list a response holds: ?page (from 1) and ?per_page
+// of the request, and the total length of the list.
+type Page struct {
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	Total   int `json:"total"`
+}
+
+// parsePage reads the page asked for from the query. If the values are invalid, the error
+// is written to w and ok is false.
+func parsePage(w http.ResponseWriter, query url.Values) (page Page, ok bool) {
+	page = Page{Page: 1, PerPage: DEFAULT_PAGE_SIZE}
+	params := []struct {
+		name  string
+		value *int
+	}{{"page", &page.Page}, {"per_page", &page.PerPage}}
+	for _, param := range params {
+		if query.Get(param.name) == "" {
+			continue
+		}
+		number, err := strconv.Atoi(query.Get(param.name))
+		if err != nil || number < 1 {
+			http.Error(w, param.name+" has to be a positive number.", http.StatusBadRequest)
+			return page, false
+		}
+		*param.value = number
+	}
+	if page.PerPage > MAX_PAGE_SIZE {
+		http.Error(w, fmt.Sprintf("per_page can be at most %d.", MAX_PAGE_SIZE), http.StatusBadRequest)
+		return page, false
+	}
+	return page, true
+}
+
+func (p Page) offset() int {
+	return (p.Page - 1) * p.PerPage
+}
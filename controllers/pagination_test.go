@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParsePage(t *testing.T) {
+	cases := []struct {
+		query string
+		page  Page
+		ok    bool
+	}{
+		{"", Page{Page: 1, PerPage: DEFAULT_PAGE_SIZE}, true},
+		{"page=3", Page{Page: 3, PerPage: DEFAULT_PAGE_SIZE}, true},
+		{"page=2&per_page=50", Page{Page: 2, PerPage: 50}, true},
+		{"per_page=100", Page{Page: 1, PerPage: MAX_PAGE_SIZE}, true},
+		{"page=", Page{Page: 1, PerPage: DEFAULT_PAGE_SIZE}, true},
+		{"per_page=101", Page{}, false},
+		{"page=0", Page{}, false},
+		{"page=-1", Page{}, false},
+		{"per_page=ten", Page{}, false},
+		{"page=1.5", Page{}, false},
+	}
+	for _, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		rec := httptest.NewRecorder()
+		page, ok := parsePage(rec, query)
+		if ok != c.ok {
+			t.Errorf("%q: got %v, want %v", c.query, ok, c.ok)
+			continue
+		}
+		if ok && page != c.page {
+			t.Errorf("%q: got %+v, want %+v", c.query, page, c.page)
+		}
+		if !ok && rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: responded with %d, want %d", c.query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestPageOffset(t *testing.T) {
+	if got := (Page{Page: 3, PerPage: 20}).offset(); got != 40 {
+		t.Errorf("got %d, want 40", got)
+	}
+}
@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"database/sql"
+	"db-queries/db"
+	"db-queries/mailer"
+	"db-queries/passwords"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"time"
+)
+
+const RESET_TOKEN_TTL_MINS = 60
+
+type PasswordResetDetails struct {
+	Email    string `json:"email"`
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// Methods: POST; path: /password/forgot
+// The response is the same whether the email is registered or not, so the endpoint
+// cannot be used to find out who has got an account.
+func (h *BaseHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var details PasswordResetDetails
+	err := json.NewDecoder(r.Body).Decode(&details)
+	if _, emailParseError := mail.ParseAddress(details.Email); err != nil || emailParseError != nil {
+		http.Error(w, "Valid email address required.", http.StatusBadRequest)
+		return
+	}
+
+	// The users of the single sign-on have no password, they are answered alike not to tell them apart.
+	user, err := db.GetUserByEmail(h.Conn, details.Email)
+	if err == nil && !user.SingleSignOn {
+		h.sendPasswordResetToken(user)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *BaseHandler) sendPasswordResetToken(user db.User) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		log.Println("Failed to generate password reset token:", err)
+		return
+	}
+
+	ttl := time.Now().Add(RESET_TOKEN_TTL_MINS * time.Minute)
+	if err := db.CreatePasswordResetToken(h.Conn, user.ID, hashToken(token), ttl); err != nil {
+		log.Println("Failed to store password reset token:", err)
+		return
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Password reset",
+		Body: fmt.Sprintf("Hi %s,\n\nTo set a new password, send the token below along with the new password "+
+			"to POST /password/reset:\n\n%s\n\nThe token expires in %d minutes. If you did not ask to reset "+
+			"your password, just ignore this email.\n", user.Username, token, RESET_TOKEN_TTL_MINS),
+	}
+	go func() {
+		if err := h.Mailer.Send(msg); err != nil {
+			log.Println("Failed to send password reset email:", err)
+		}
+	}()
+}
+
+// Methods: POST; path: /password/reset
+func (h *BaseHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var details PasswordResetDetails
+	err := json.NewDecoder(r.Body).Decode(&details)
+	if err != nil || details.Token == "" || details.Password == "" {
+		http.Error(w, "Token and new password required.", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Passwords.Validate(details.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := passwords.Hash(details.Password)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := db.ResetPassword(h.Conn, hashToken(details.Token), hash)
+	if err == db.ErrResetTokenInvalid {
+		http.Error(w, "Token invalid or expired.", http.StatusBadRequest)
+		return
+	}
+	if err == db.ErrPasswordSingleSignOn {
+		http.Error(w, "The account logs in with single sign-on and has no password.", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.access.forget(userID)
+}
+
+type PasswordChangeDetails struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type PasswordPolicyResponse struct {
+	*passwords.Policy
+	BreachedListChecked bool `json:"breachedListChecked"`
+}
+
+// Methods: GET; path: /password/policy
+// Lets the clients tell the users the rules before they pick a password.
+func (h *BaseHandler) PasswordPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(PasswordPolicyResponse{h.Passwords, h.Passwords.BreachedListSize() > 0})
+}
+
+// Methods: POST; path: /me/password
+// Wrong current passwords count as failed logins, so the endpoint cannot be used to get
+// around the login throttling. All the sessions of the user but the current one are ended.
+func (h *BaseHandler) ChangePassword(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if authReq.Method != "POST" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var details PasswordChangeDetails
+	err := json.NewDecoder(authReq.Body).Decode(&details)
+	if err != nil || details.CurrentPassword == "" || details.NewPassword == "" {
+		http.Error(w, "Current and new password required.", http.StatusBadRequest)
+		return
+	}
+
+	user, err := db.GetUserByID(h.Conn, authReq.user.ID)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if user.SingleSignOn {
+		http.Error(w, "The account logs in with single sign-on and has no password.", http.StatusForbidden)
+		return
+	}
+
+	ip := h.clientIP(authReq.Request)
+	attempt, lockedFor, err := h.reserveLoginAttempt(authReq.user.Email, ip)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if lockedFor > 0 {
+		tooManyLoginAttempts(w, lockedFor)
+		return
+	}
+
+	_, err = h.verifyPassword(authReq.user.Email, details.CurrentPassword)
+	if err == sql.ErrNoRows {
+		h.registerLoginFailure(authReq.user.Email, ip)
+		http.Error(w, "Current password incorrect.", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		h.releaseLoginAttempt(attempt)
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.registerLoginSuccess(authReq.user.Email)
+	h.releaseLoginAttempt(attempt)
+
+	if details.NewPassword == details.CurrentPassword {
+		http.Error(w, "New password must differ from the current one.", http.StatusBadRequest)
+		return
+	}
+	if err := h.Passwords.Validate(details.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := passwords.Hash(details.NewPassword)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	until := time.Now().Add(TOKEN_TTL_MINS * time.Minute)
+	err = db.ChangePassword(h.Conn, authReq.user.ID, hash, authReq.user.SessionID, until)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
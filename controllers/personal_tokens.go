@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"db-queries/db"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Personal access tokens are API keys the users create for their own scripts and integrations.
+// They act on behalf of the user within the scopes, just like the keys issued by the admins.
+
+const PERSONAL_TOKEN_NAME_MAX_LENGTH = 64
+const PERSONAL_TOKEN_ID_POSITION_IN_URL_PATH = 3
+
+var (
+	VALID_PERSONAL_TOKEN_SCOPES = map[string]bool{
+		SCOPE_TICKETS_READ:   true,
+		SCOPE_TICKETS_WRITE:  true,
+		SCOPE_MESSAGES_WRITE: true,
+	}
+	personalTokenOperationRegex, _ = regexp.Compile("^/me/tokens/[0-9]+[/]?$")
+)
+
+type PersonalTokenDetails struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// Methods: GET/POST; path: /me/tokens
+func (h *BaseHandler) PersonalTokensListAllOrCreateOne(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	switch authReq.Method {
+	case "GET":
+		h.GetPersonalTokens(w, authReq)
+	case "POST":
+		h.CreatePersonalToken(w, authReq)
+	default:
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// Methods: DELETE; path: /me/tokens/{id}
+func (h *BaseHandler) PersonalTokensDetailedView(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !personalTokenOperationRegex.MatchString(authReq.URL.Path) {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	tokenId := strings.Split(authReq.URL.Path, "/")[PERSONAL_TOKEN_ID_POSITION_IN_URL_PATH]
+	switch authReq.Method {
+	case "DELETE":
+		h.RevokePersonalToken(tokenId, w, authReq)
+	default:
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *BaseHandler) GetPersonalTokens(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	tokens, err := db.GetApiKeysOfOwner(h.Conn, authReq.user.ID, db.API_KEY_KIND_PERSONAL)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// CreatePersonalToken issues a token to the user. Every token expires: in
+// PersonalTokenDefaultTTLDays unless expiresAt is given, at most in PersonalTokenMaxTTLDays.
+// The token is only ever shown in this response.
+func (h *BaseHandler) CreatePersonalToken(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	var details PersonalTokenDetails
+	err := json.NewDecoder(authReq.Body).Decode(&details)
+	if err != nil || details.Name == "" || len(details.Scopes) == 0 {
+		http.Error(w, "Missing fields in payload: expected name and scopes.", http.StatusBadRequest)
+		return
+	}
+	if len(details.Name) > PERSONAL_TOKEN_NAME_MAX_LENGTH {
+		http.Error(w, "Name too long.", http.StatusBadRequest)
+		return
+	}
+
+	if !validScopes(w, details.Scopes, VALID_PERSONAL_TOKEN_SCOPES) {
+		return
+	}
+
+	now := time.Now()
+	if details.ExpiresAt == nil {
+		expiresAt := now.AddDate(0, 0, h.Config.PersonalTokenDefaultTTLDays)
+		details.ExpiresAt = &expiresAt
+	}
+	if details.ExpiresAt.Before(now) {
+		http.Error(w, "Expiry date is in the past.", http.StatusBadRequest)
+		return
+	}
+	if details.ExpiresAt.After(now.AddDate(0, 0, h.Config.PersonalTokenMaxTTLDays)) {
+		http.Error(w, "Expiry date is too far in the future.", http.StatusBadRequest)
+		return
+	}
+
+	count, err := db.CountUsableApiKeysOfOwner(h.Conn, authReq.user.ID, db.API_KEY_KIND_PERSONAL)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if count >= h.Config.PersonalTokensMaxPerUser {
+		http.Error(w, "Too many tokens, revoke some first.", http.StatusConflict)
+		return
+	}
+
+	created, err := h.issueApiKey(authReq.user.ID, authReq.user.ID, db.API_KEY_KIND_PERSONAL, details.Name,
+		details.Scopes, details.ExpiresAt)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (h *BaseHandler) RevokePersonalToken(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !db.RevokeApiKeyOfOwner(h.Conn, id, authReq.user.ID, db.API_KEY_KIND_PERSONAL) {
+		http.Error(w, "Token does not exist or has already been revoked.", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,25 @@
+package controllers
+
+import "net/http"
+
+// can reports whether the requester's role has been granted the permission.
+func (r Requester) can(permission string) bool {
+	for _, p := range r.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize is the single place authorization decisions are made in: it responds with 403
+// and returns false unless the requester has at least one of the permissions.
+func authorize(w http.ResponseWriter, authReq *AuthenticatedRequest, permissions ...string) bool {
+	for _, permission := range permissions {
+		if authReq.user.can(permission) {
+			return true
+		}
+	}
+	http.Error(w, "No permissions to perform this action.", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"db-queries/db"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// clientIP returns the address the request came from. X-Forwarded-For is only trusted
+// when the app runs behind a proxy, in which case the proxy's entry (the last one) is used.
+func (h *BaseHandler) clientIP(r *http.Request) string {
+	if h.Config.TrustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// LOGIN_ATTEMPT_HOLD bounds the time an attempt keeps the account and the ip reserved, should
+// the app stop before the attempt has been evaluated.
+const LOGIN_ATTEMPT_HOLD = 30 * time.Second
+
+// loginAttempt is the right to evaluate one attempt to log into the account from the ip.
+type loginAttempt struct {
+	email, ip     string
+	reservedUntil time.Time
+}
+
+// reserveLoginAttempt reserves the account and the ip for one attempt, so that the attempts made
+// meanwhile, be they concurrent, are turned down rather than evaluated. If either is locked, the
+// client is told how long to wait instead. The attempt ends with registerLoginFailure, or
+// registerLoginSuccess followed by releaseLoginAttempt, or just the latter if it could not be evaluated.
+func (h *BaseHandler) reserveLoginAttempt(email, ip string) (attempt loginAttempt, lockedFor time.Duration, err error) {
+	reservedUntil, lockedUntil, err := db.ReserveLoginKeys(h.Conn, LOGIN_ATTEMPT_HOLD,
+		accountThrottleKey(email), ipThrottleKey(ip))
+	if err != nil {
+		return attempt, 0, err
+	}
+	if reservedUntil.IsZero() {
+		// The lock may have just ended, the client still has to try again.
+		if lockedFor = time.Until(lockedUntil); lockedFor < time.Second {
+			lockedFor = time.Second
+		}
+		return attempt, lockedFor, nil
+	}
+	return loginAttempt{email: email, ip: ip, reservedUntil: reservedUntil}, 0, nil
+}
+
+func (h *BaseHandler) releaseLoginAttempt(attempt loginAttempt) {
+	err := db.ReleaseLoginKeys(h.Conn, attempt.reservedUntil, accountThrottleKey(attempt.email), ipThrottleKey(attempt.ip))
+	if err != nil {
+		log.Println("Failed to release login attempt:", err)
+	}
+}
+
+// registerLoginFailure makes both the account and the ip wait before the next attempt:
+// exponentially longer with every failure, and for the whole lockout period once the
+// threshold is reached.
+func (h *BaseHandler) registerLoginFailure(email, ip string) {
+	lockout := time.Duration(h.Config.LoginLockoutMins) * time.Minute
+	keys := map[string]int{
+		accountThrottleKey(email): h.Config.LoginMaxFailuresPerAccount,
+		ipThrottleKey(ip):         h.Config.LoginMaxFailuresPerIP,
+	}
+
+	for key, threshold := range keys {
+		failures, err := db.RegisterLoginFailure(h.Conn, key, lockout)
+		if err != nil {
+			log.Println("Failed to register login failure:", err)
+			continue
+		}
+
+		delay := lockout
+		if failures < threshold {
+			delay = h.backoff(failures)
+		}
+		if err := db.LockLoginKey(h.Conn, key, time.Now().Add(delay)); err != nil {
+			log.Println("Failed to lock login key:", err)
+		}
+	}
+}
+
+func tooManyLoginAttempts(w http.ResponseWriter, lockedFor time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockedFor.Seconds()))))
+	http.Error(w, "Too many failed login attempts.", http.StatusTooManyRequests)
+}
+
+func (h *BaseHandler) registerLoginSuccess(email string) {
+	if err := db.ClearLoginThrottle(h.Conn, accountThrottleKey(email)); err != nil {
+		log.Println("Failed to clear login throttle:", err)
+	}
+}
+
+func (h *BaseHandler) backoff(failures int) time.Duration {
+	secs := float64(h.Config.LoginBackoffBaseSecs) * math.Pow(2, float64(failures-1))
+	if secs > float64(h.Config.LoginBackoffMaxSecs) {
+		secs = float64(h.Config.LoginBackoffMaxSecs)
+	}
+	return time.Duration(secs) * time.Second
+}
@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"db-queries/db"
+	"db-queries/passwords"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogInConcurrentAttempts(t *testing.T) {
+	conn := openTestDB(t)
+	keys, err := NewEphemeralKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewBaseHandler(conn, keys, nil, nil, NewConfigFromEnv())
+
+	now := time.Now().UnixNano()
+	email := fmt.Sprintf("user-%d@example.com", now)
+	hash, err := passwords.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateUser(conn, email, hash, "user", db.ROLE_CUSTOMER); err != nil {
+		t.Fatal(err)
+	}
+
+	const attempts = 20
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"email": %q, "password": "wrong horse %d"}`, email, i)
+			r := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+			r.RemoteAddr = fmt.Sprintf("10.%d.%d.%d:1234", now%200, i, now%250)
+			rec := httptest.NewRecorder()
+			h.LogIn(rec, r)
+			codes <- rec.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	evaluated := 0
+	for code := range codes {
+		switch code {
+		case http.StatusNotFound:
+			evaluated++
+		case http.StatusTooManyRequests:
+		default:
+			t.Errorf("got %d, want %d or %d", code, http.StatusNotFound, http.StatusTooManyRequests)
+		}
+	}
+	if evaluated != 1 {
+		t.Errorf("%d of %d concurrent attempts evaluated, want 1", evaluated, attempts)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		trustProxy bool
+		remoteAddr string
+		forwarded  string
+		ip         string
+	}{
+		{false, "192.0.2.1:1234", "", "192.0.2.1"},
+		{false, "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{false, "[2001:db8::1]:1234", "", "2001:db8::1"},
+		{false, "192.0.2.1", "", "192.0.2.1"},
+		{true, "192.0.2.1:1234", "", "192.0.2.1"},
+		{true, "192.0.2.1:1234", "198.51.100.7", "198.51.100.7"},
+		{true, "192.0.2.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{true, "192.0.2.1:1234", "203.0.113.9,198.51.100.7 ", "198.51.100.7"},
+	}
+	for _, c := range cases {
+		h := &BaseHandler{Config: Config{TrustProxyHeaders: c.trustProxy}}
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := h.clientIP(r); got != c.ip {
+			t.Errorf("%+v: got %s, want %s", c, got, c.ip)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	h := &BaseHandler{Config: Config{LoginBackoffBaseSecs: 1, LoginBackoffMaxSecs: 60}}
+	cases := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+	for _, c := range cases {
+		if got := h.backoff(c.failures); got != c.delay {
+			t.Errorf("%d failures: got %v, want %v", c.failures, got, c.delay)
+		}
+	}
+}
@@ -36,7 +36,12 @@ func (h *BaseHandler) TicketsListAllOrCreateOne(w http.ResponseWriter, authReq *
 }
 
 func (h *BaseHandler) GetAllTickets(w http.ResponseWriter, authReq *AuthenticatedRequest) {
-	tickets, err := db.GetTicketsForUser(h.Conn, authReq.user.Email, authReq.user.IsStaff, authReq.user.IsSuperuser)
+	if !requireScope(w, authReq, SCOPE_TICKETS_READ) ||
+		!authorize(w, authReq, db.PERM_TICKETS_READ_OWN, db.PERM_TICKETS_READ_ANY) {
+		return
+	}
+
+	tickets, err := db.GetTicketsForUser(h.Conn, authReq.user.ID, authReq.user.can(db.PERM_TICKETS_READ_ANY))
 	if err != nil {
 		http.Error(w, "Please try again later.", http.StatusInternalServerError)
 		return
@@ -48,6 +53,11 @@ func (h *BaseHandler) GetAllTickets(w http.ResponseWriter, authReq *Authenticate
 }
 
 func (h *BaseHandler) CreateTicket(w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !requireScope(w, authReq, SCOPE_TICKETS_WRITE) || !authorize(w, authReq, db.PERM_TICKETS_CREATE) ||
+		!h.requireVerifiedEmail(w, authReq) {
+		return
+	}
+
 	if authReq.Body == nil {
 		http.Error(w, "Payload expected.", http.StatusBadRequest)
 		return
@@ -65,7 +75,7 @@ func (h *BaseHandler) CreateTicket(w http.ResponseWriter, authReq *Authenticated
 		return
 	}
 
-	id, err := db.CreateTicket(h.Conn, authReq.user.Email, ticket.Topic, ticket.Text)
+	id, err := db.CreateTicket(h.Conn, authReq.user.ID, ticket.Topic, ticket.Text)
 	if err != nil {
 		pqErr := err.(*pq.Error)
 		if pqErr.Code.Name() == db.VALUE_TOO_LONG_ERR_CODE_NAME {
@@ -116,7 +126,12 @@ func (h *BaseHandler) TicketsDetailedView(res http.ResponseWriter, authReq *Auth
 }
 
 func (h *BaseHandler) GetOneTicket(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
-	ticket, err := db.GetOneTicketForUser(h.Conn, id, authReq.user.Email, authReq.user.IsStaff, authReq.user.IsSuperuser)
+	if !requireScope(w, authReq, SCOPE_TICKETS_READ) ||
+		!authorize(w, authReq, db.PERM_TICKETS_READ_OWN, db.PERM_TICKETS_READ_ANY) {
+		return
+	}
+
+	ticket, err := db.GetOneTicketForUser(h.Conn, id, authReq.user.ID, authReq.user.can(db.PERM_TICKETS_READ_ANY))
 	if err != nil {
 		http.Error(w, "Ticket does not exist or does not belong to this user.", http.StatusNotFound)
 		return
@@ -127,20 +142,32 @@ func (h *BaseHandler) GetOneTicket(id string, w http.ResponseWriter, authReq *Au
 }
 
 func (h *BaseHandler) UpdateTicket(id string, res http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !requireScope(res, authReq, SCOPE_TICKETS_WRITE) {
+		return
+	}
+
 	var ticket TicketDetails
 	err := json.NewDecoder(authReq.Body).Decode(&ticket)
 	if err != nil {
 		http.Error(res, "Invalid payload.", http.StatusBadRequest)
 		return
 	}
-	validChangeByStaff := (authReq.user.IsStaff || authReq.user.IsSuperuser) && db.VALID_TICKET_STATUS_STAFF[ticket.Status]
-	validChangeByCommonUser := !(authReq.user.IsStaff || authReq.user.IsSuperuser) && db.VALID_TICKET_STATUS_COMMON_USER[ticket.Status]
-	if !(validChangeByStaff || validChangeByCommonUser) {
+
+	// Resolving applies to any ticket, canceling only to the user's own ones.
+	var permission string
+	switch {
+	case db.VALID_TICKET_STATUS_STAFF[ticket.Status]:
+		permission = db.PERM_TICKETS_STATUS_RESOLVE
+	case db.VALID_TICKET_STATUS_COMMON_USER[ticket.Status]:
+		permission = db.PERM_TICKETS_STATUS_CANCEL
+	}
+	if permission == "" || !authReq.user.can(permission) {
 		http.Error(res, "Invalid status.", http.StatusBadRequest)
 		return
 	}
 
-	if !db.UpdateTicket(h.Conn, id, ticket.Status) {
+	updateAny := permission == db.PERM_TICKETS_STATUS_RESOLVE
+	if !db.UpdateTicket(h.Conn, id, ticket.Status, authReq.user.ID, updateAny) {
 		http.Error(res, "Ticket does not exist or does not belong to this user.", http.StatusNotFound)
 	}
 }
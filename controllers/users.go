@@ -1,31 +1,52 @@
 package controllers
 
 import (
+	"database/sql"
 	"db-queries/db"
+	"db-queries/passwords"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"net/mail"
-	"os"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/lib/pq"
 )
 
-const PASSWORD_MIN_LENGTH = 8
+var userDetailRegex, _ = regexp.Compile("^/users/[0-9]+[/]?$")
+var userUnlockRegex, _ = regexp.Compile("^/users/[0-9]+/unlock[/]?$")
+var userImpersonateRegex, _ = regexp.Compile("^/users/[0-9]+/impersonate[/]?$")
+var userDeactivateRegex, _ = regexp.Compile("^/users/[0-9]+/deactivate[/]?$")
+var userReactivateRegex, _ = regexp.Compile("^/users/[0-9]+/reactivate[/]?$")
+var userEraseRegex, _ = regexp.Compile("^/users/[0-9]+/erase[/]?$")
+
+// UserDetailedResponse is the user along with a page of their tickets.
+type UserDetailedResponse struct {
+	db.UserOverview
+	Tickets     []db.Ticket `json:"tickets"`
+	TicketsPage Page        `json:"tickets_page"`
+}
+
+// FieldChange is an entry of the audit record of a user update.
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
 
 type UserDetails struct {
-	IsStaff     bool   `json:"isStaff"`
-	IsSuperuser bool   `json:"isSuperuser"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
-	Username    string `json:"username"`
+	IsStaff  bool   `json:"isStaff"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Username string `json:"username"`
 }
 
 func (h *BaseHandler) UsersListAllOrCreateOne(w http.ResponseWriter, req *http.Request) {
 	switch {
 	case req.Method == "GET":
-		handler := JWTMiddleWare(h.GetAllUsers)
+		handler := h.JWTMiddleWare(h.GetAllUsers)
 		handler.ServeHTTP(w, req)
 	case req.Method == "POST":
 		h.CreateUser(w, req)
@@ -48,55 +69,477 @@ func (h *BaseHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(user.Password) < PASSWORD_MIN_LENGTH {
-		http.Error(w, fmt.Sprintf("Password min length is %d", PASSWORD_MIN_LENGTH), http.StatusBadRequest)
+	if err := h.Passwords.Validate(user.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	staffStatus := false
+	role := db.ROLE_CUSTOMER
 	if user.IsStaff {
-		reqToken := r.Header.Get("Authorization")
-		if reqToken == "" {
+		token, present, err := bearerToken(r)
+		if !present {
 			http.Error(w, "Token missing.", http.StatusUnauthorized)
 			return
 		}
-
-		splitToken := strings.Split(reqToken, "Bearer")
-		if len(splitToken) != 2 {
-			http.Error(w, "Token of wrong format.", http.StatusUnauthorized)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		token := strings.TrimSpace(splitToken[1])
-		if token != os.Getenv("STAFF_TOKEN") {
+		_, scopes, owner, err := db.UseApiKey(h.Conn, hashToken(token))
+		if err == sql.ErrNoRows || (err == nil && !containsScope(scopes, SCOPE_STAFF_ONBOARD)) {
 			http.Error(w, "Token invalid", http.StatusUnauthorized)
 			return
 		}
+		if err != nil {
+			http.Error(w, "Please try again later.", http.StatusInternalServerError)
+			return
+		}
+
+		// The key only onboards staff for as long as its owner is still allowed to.
+		permissions, err := db.GetPermissionsOfRole(h.Conn, owner.Role)
+		if err != nil {
+			http.Error(w, "Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		if !(Requester{Permissions: permissions}).can(db.PERM_USERS_ROLES) {
+			http.Error(w, "No permissions to perform this action.", http.StatusForbidden)
+			return
+		}
+
+		role = db.ROLE_AGENT
+	}
 
-		staffStatus = true
+	hash, err := passwords.Hash(user.Password)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
 	}
 
-	if err := db.CreateUser(h.Conn, user.Email, user.Password, user.Username, staffStatus, false); err != nil {
-		pqErr := err.(*pq.Error)
-		if pqErr.Code.Name() == db.UNIQUE_VIOLATION_ERR_CODE_NAME {
+	id, err := db.CreateUser(h.Conn, user.Email, hash, user.Username, role)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == db.UNIQUE_VIOLATION_ERR_CODE_NAME {
 			http.Error(w, "User with specified email already exists.", http.StatusBadRequest)
 			return
 		}
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
 	}
+
+	h.sendVerificationEmail(db.User{ID: id, Email: user.Email, Username: user.Username})
 	w.WriteHeader(http.StatusCreated)
 }
 
+// GetAllUsers lists the users a page at a time, the total number matching the filters in the
+// X-Total-Count header.
 func (h *BaseHandler) GetAllUsers(w http.ResponseWriter, authReq *AuthenticatedRequest) {
-	if authReq.user.IsStaff || authReq.user.IsSuperuser {
-		users, err := db.GetAllUsers(h.Conn)
+	if !authorize(w, authReq, db.PERM_USERS_LIST) {
+		return
+	}
+
+	query := authReq.URL.Query()
+	page, ok := parsePage(w, query)
+	if !ok {
+		return
+	}
+	filter, ok := parseUserFilter(w, query)
+	if !ok {
+		return
+	}
+	sortKey, desc, ok := parseUserSort(w, query.Get("sort"))
+	if !ok {
+		return
+	}
+
+	total, err := db.CountUsers(h.Conn, filter)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	users, err := db.GetUsersPage(h.Conn, filter, sortKey, desc, page.PerPage, page.offset())
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(users)
+}
+
+// parseUserFilter reads ?staff, ?created_from, ?created_to and ?q. The dates are either
+// RFC 3339 timestamps or whole days, created_to including the day.
+func parseUserFilter(w http.ResponseWriter, query url.Values) (filter db.UserFilter, ok bool) {
+	if value := query.Get("staff"); value != "" {
+		staff, err := strconv.ParseBool(value)
 		if err != nil {
-			http.Error(w, "Please try again later.", http.StatusInternalServerError)
-			return
+			http.Error(w, "staff has to be true or false.", http.StatusBadRequest)
+			return filter, false
+		}
+		filter.Staff = &staff
+	}
+
+	dates := []struct {
+		name     string
+		value    **time.Time
+		endOfDay bool
+	}{{"created_from", &filter.CreatedFrom, false}, {"created_to", &filter.CreatedTo, true}}
+	for _, date := range dates {
+		value := query.Get(date.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t, err = time.Parse("2006-01-02", value)
+			if err == nil && date.endOfDay {
+				t = t.AddDate(0, 0, 1).Add(-time.Microsecond)
+			}
+		}
+		if err != nil {
+			http.Error(w, date.name+" has to be a date (2006-01-02) or an RFC 3339 timestamp.", http.StatusBadRequest)
+			return filter, false
+		}
+		*date.value = &t
+	}
+
+	filter.Search = strings.TrimSpace(query.Get("q"))
+	if len(filter.Search) > 64 {
+		http.Error(w, "q can be at most 64 characters long.", http.StatusBadRequest)
+		return filter, false
+	}
+	return filter, true
+}
+
+// parseUserSort reads ?sort, one of db.USER_SORT_KEYS, descending if prefixed with "-".
+// The users with the most tickets come first by default.
+func parseUserSort(w http.ResponseWriter, value string) (sortKey string, desc bool, ok bool) {
+	if value == "" {
+		return "tickets_count", true, true
+	}
+	sortKey = strings.TrimPrefix(value, "-")
+	if _, valid := db.USER_SORT_KEYS[sortKey]; !valid {
+		http.Error(w, "Invalid sort, expected one of: id, created_at, username, email, tickets_count, "+
+			"prefixed with - for descending.", http.StatusBadRequest)
+		return "", false, false
+	}
+	return sortKey, sortKey != value, true
+}
+
+func (h *BaseHandler) UsersDetailedView(res http.ResponseWriter, authReq *AuthenticatedRequest) {
+	// Methods: GET; path: /users/{id}
+	if userDetailRegex.MatchString(authReq.URL.Path) {
+		userId := strings.Split(authReq.URL.Path, "/")[ID_POSITION_IN_URL_PATH]
+		switch {
+		case authReq.Method == "GET":
+			h.GetUser(userId, res, authReq)
+		case authReq.Method == "PATCH":
+			h.UpdateUser(userId, res, authReq)
+		default:
+			http.Error(res, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	// Methods: POST; path: /users/{id}/unlock
+	if userUnlockRegex.MatchString(authReq.URL.Path) {
+		userId := strings.Split(authReq.URL.Path, "/")[ID_POSITION_IN_URL_PATH]
+		switch {
+		case authReq.Method == "POST":
+			h.UnlockUser(userId, res, authReq)
+		default:
+			http.Error(res, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	// Methods: POST; path: /users/{id}/impersonate
+	if userImpersonateRegex.MatchString(authReq.URL.Path) {
+		userId := strings.Split(authReq.URL.Path, "/")[ID_POSITION_IN_URL_PATH]
+		switch {
+		case authReq.Method == "POST":
+			h.ImpersonateUser(userId, res, authReq)
+		default:
+			http.Error(res, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	// Methods: POST; path: /users/{id}/deactivate
+	if userDeactivateRegex.MatchString(authReq.URL.Path) {
+		userId := strings.Split(authReq.URL.Path, "/")[ID_POSITION_IN_URL_PATH]
+		switch {
+		case authReq.Method == "POST":
+			h.DeactivateUser(userId, res, authReq)
+		default:
+			http.Error(res, "Method Not Allowed.", http.StatusMethodNotAllowed)
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(users)
 		return
 	}
-	http.Error(w, "No permissions to perform this action.", http.StatusUnauthorized)
+	// Methods: POST; path: /users/{id}/reactivate
+	if userReactivateRegex.MatchString(authReq.URL.Path) {
+		userId := strings.Split(authReq.URL.Path, "/")[ID_POSITION_IN_URL_PATH]
+		switch {
+		case authReq.Method == "POST":
+			h.ReactivateUser(userId, res, authReq)
+		default:
+			http.Error(res, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	// Methods: POST; path: /users/{id}/erase
+	if userEraseRegex.MatchString(authReq.URL.Path) {
+		userId := strings.Split(authReq.URL.Path, "/")[ID_POSITION_IN_URL_PATH]
+		switch {
+		case authReq.Method == "POST":
+			h.EraseUser(userId, res, authReq)
+		default:
+			http.Error(res, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	// Methods: GET; path: /users/{id}/logins
+	if userLoginsRegex.MatchString(authReq.URL.Path) {
+		userId := strings.Split(authReq.URL.Path, "/")[ID_POSITION_IN_URL_PATH]
+		switch {
+		case authReq.Method == "GET":
+			h.UserLogins(userId, res, authReq)
+		default:
+			http.Error(res, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	// Methods: GET; path: /users/{id}/export
+	if userExportRegex.MatchString(authReq.URL.Path) {
+		userId := strings.Split(authReq.URL.Path, "/")[ID_POSITION_IN_URL_PATH]
+		switch {
+		case authReq.Method == "GET":
+			h.UserExport(userId, res, authReq)
+		default:
+			http.Error(res, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	http.Error(res, "", http.StatusBadRequest)
+}
+
+// GetUser shows the staff the user along with their tickets: the counts per status and
+// a page of them, the latest first.
+func (h *BaseHandler) GetUser(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !authorize(w, authReq, db.PERM_USERS_LIST) || !authorize(w, authReq, db.PERM_TICKETS_READ_ANY) {
+		return
+	}
+
+	page, ok := parsePage(w, authReq.URL.Query())
+	if !ok {
+		return
+	}
+
+	userId, _ := strconv.Atoi(id)
+	overview, err := db.GetUserOverview(h.Conn, userId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	tickets, err := db.GetTicketsPageOfUser(h.Conn, overview.ID, page.PerPage, page.offset())
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	page.Total = overview.TicketsCount
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(UserDetailedResponse{overview, tickets, page})
+}
+
+// UpdateUser changes the fields of the user present in the payload. Anybody can change their own
+// username, the users:edit permission is needed for the ones of others, users:roles for the role
+// and users:deactivate for the status. As with deactivation, the staff can only be edited by
+// the ones who manage roles, and nobody can change their own role or status.
+func (h *BaseHandler) UpdateUser(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	userId, _ := strconv.Atoi(id)
+	self := userId == authReq.user.ID
+	if !self && !authorize(w, authReq, db.PERM_USERS_EDIT, db.PERM_USERS_ROLES, db.PERM_USERS_DEACTIVATE) {
+		return
+	}
+
+	var changes db.UserChanges
+	decoder := json.NewDecoder(authReq.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&changes); err != nil {
+		http.Error(w, "Invalid payload: only username, role and active can be changed.", http.StatusBadRequest)
+		return
+	}
+
+	if changes.Username != nil && !validUsername(w, changes.Username) {
+		return
+	}
+	if changes.Role != nil && !db.VALID_ROLES[*changes.Role] {
+		http.Error(w, "Invalid role: "+*changes.Role, http.StatusBadRequest)
+		return
+	}
+	if self && (changes.Role != nil || changes.Active != nil) {
+		http.Error(w, "Unable to change the role or status of own account.", http.StatusBadRequest)
+		return
+	}
+
+	user, err := db.GetUserByID(h.Conn, userId)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+	if !self && !authorizeUserChanges(w, authReq, user, changes) {
+		return
+	}
+
+	before, err := db.UpdateUser(h.Conn, user.ID, changes)
+	if err == db.ErrUserErased {
+		http.Error(w, "User has been erased.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.access.forget(user.ID)
+
+	after, err := db.GetUserByID(h.Conn, user.ID)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	changed := map[string]FieldChange{}
+	if before.Username != after.Username {
+		changed["username"] = FieldChange{before.Username, after.Username}
+	}
+	if before.Role != after.Role {
+		changed["role"] = FieldChange{before.Role, after.Role}
+	}
+	if before.Active != after.Active {
+		changed["active"] = FieldChange{before.Active, after.Active}
+	}
+	if len(changed) > 0 {
+		h.audit(authReq.user.ID, user.ID, db.AUDIT_USER_UPDATE, changed)
+	}
+
+	overview, err := db.GetUserOverview(h.Conn, user.ID)
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(overview)
+}
+
+// validUsername trims the username and responds with 400 and returns false if it is empty or
+// too long.
+func validUsername(w http.ResponseWriter, username *string) bool {
+	*username = strings.TrimSpace(*username)
+	if *username == "" || len(*username) > 64 {
+		http.Error(w, "Username has to be 1 to 64 characters long.", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// authorizeUserChanges checks the permissions needed for the changes to another user.
+func authorizeUserChanges(w http.ResponseWriter, authReq *AuthenticatedRequest, user db.User, changes db.UserChanges) bool {
+	if changes.Username != nil && !authorize(w, authReq, db.PERM_USERS_EDIT) {
+		return false
+	}
+	if changes.Role != nil && !authorize(w, authReq, db.PERM_USERS_ROLES) {
+		return false
+	}
+	if changes.Active != nil && !authorize(w, authReq, db.PERM_USERS_DEACTIVATE) {
+		return false
+	}
+	if db.IsStaffRole(user.Role) && !authorize(w, authReq, db.PERM_USERS_ROLES) {
+		return false
+	}
+	return true
+}
+
+// UnlockUser lifts the lock put on the account after too many failed login attempts.
+func (h *BaseHandler) UnlockUser(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	if !authorize(w, authReq, db.PERM_USERS_UNLOCK) {
+		return
+	}
+
+	userId, _ := strconv.Atoi(id)
+	user, err := db.GetUserByID(h.Conn, userId)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+
+	if err := db.ClearLoginThrottle(h.Conn, accountThrottleKey(user.Email)); err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+}
+
+// DeactivateUser locks the user out. Their tokens stop being accepted within
+// ACCESS_CACHE_TTL_SECS, right away on this instance.
+func (h *BaseHandler) DeactivateUser(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	user, ok := h.userToSetActive(id, w, authReq)
+	if !ok {
+		return
+	}
+
+	if err := db.DeactivateUser(h.Conn, user.ID); err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.access.forget(user.ID)
+	h.audit(authReq.user.ID, user.ID, db.AUDIT_USER_DEACTIVATE, struct{}{})
+}
+
+// ReactivateUser lets the user log in again. The tokens issued before the deactivation
+// remain rejected.
+func (h *BaseHandler) ReactivateUser(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) {
+	user, ok := h.userToSetActive(id, w, authReq)
+	if !ok {
+		return
+	}
+
+	err := db.ReactivateUser(h.Conn, user.ID)
+	if err == db.ErrUserErased {
+		http.Error(w, "User has been erased.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	h.access.forget(user.ID)
+	h.audit(authReq.user.ID, user.ID, db.AUDIT_USER_REACTIVATE, struct{}{})
+}
+
+// userToSetActive looks up the user to be (de)activated. The staff can only be (de)activated by
+// the ones who manage roles, and nobody can do it to themselves.
+func (h *BaseHandler) userToSetActive(id string, w http.ResponseWriter, authReq *AuthenticatedRequest) (user db.User, ok bool) {
+	if !authorize(w, authReq, db.PERM_USERS_DEACTIVATE) {
+		return user, false
+	}
+
+	userId, _ := strconv.Atoi(id)
+	user, err := db.GetUserByID(h.Conn, userId)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return user, false
+	}
+	if user.ID == authReq.user.ID {
+		http.Error(w, "Unable to change the status of own account.", http.StatusBadRequest)
+		return user, false
+	}
+	if db.IsStaffRole(user.Role) && !authorize(w, authReq, db.PERM_USERS_ROLES) {
+		return user, false
+	}
+	return user, true
 }
@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseUserSort(t *testing.T) {
+	cases := []struct {
+		value   string
+		sortKey string
+		desc    bool
+		ok      bool
+	}{
+		{"", "tickets_count", true, true},
+		{"id", "id", false, true},
+		{"-created_at", "created_at", true, true},
+		{"username", "username", false, true},
+		{"-email", "email", true, true},
+		{"tickets_count", "tickets_count", false, true},
+		{"password", "", false, false},
+		{"--id", "", false, false},
+		{"-", "", false, false},
+		{"ID", "", false, false},
+		{"u.id; DROP TABLE users", "", false, false},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		sortKey, desc, ok := parseUserSort(rec, c.value)
+		if sortKey != c.sortKey || desc != c.desc || ok != c.ok {
+			t.Errorf("%q: got %q, %v, %v, want %q, %v, %v", c.value, sortKey, desc, ok, c.sortKey, c.desc, c.ok)
+		}
+		if !ok && rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: responded with %d, want %d", c.value, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"db-queries/db"
+	"db-queries/mailer"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+const VERIFICATION_TOKEN_TTL_HOURS = 48
+
+const (
+	// Unverified users can neither log in nor use the tokens issued before.
+	UNVERIFIED_POLICY_BLOCK = "block"
+	// Unverified users can log in and read, but not open tickets or write messages.
+	UNVERIFIED_POLICY_LIMITED = "limited"
+	// Email verification is not enforced at all.
+	UNVERIFIED_POLICY_ALLOW = "allow"
+)
+
+type EmailDetails struct {
+	Email string `json:"email"`
+}
+
+// Methods: GET/POST; path: /users/verify
+func (h *BaseHandler) UsersVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		h.VerifyEmail(w, r)
+	case "POST":
+		h.ResendVerificationEmail(w, r)
+	default:
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *BaseHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Token expected.", http.StatusBadRequest)
+		return
+	}
+
+	change, err := db.VerifyEmail(h.Conn, hashToken(token))
+	if err == db.ErrVerificationTokenInvalid {
+		http.Error(w, "Token invalid or expired.", http.StatusBadRequest)
+		return
+	}
+	if err == db.ErrEmailTaken {
+		http.Error(w, "User with specified email already exists.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	if change.NewEmail != "" {
+		h.access.forget(change.UserID)
+		h.sendEmailChangedEmail(change)
+		w.Write([]byte("Email address changed."))
+		return
+	}
+	w.Write([]byte("Email address verified."))
+}
+
+// Like with password reset, the response does not reveal whether the email is registered.
+func (h *BaseHandler) ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	var details EmailDetails
+	err := json.NewDecoder(r.Body).Decode(&details)
+	if _, emailParseError := mail.ParseAddress(details.Email); err != nil || emailParseError != nil {
+		http.Error(w, "Valid email address required.", http.StatusBadRequest)
+		return
+	}
+
+	user, err := db.GetUserByEmail(h.Conn, details.Email)
+	if err == nil && !user.EmailVerified {
+		h.sendVerificationEmail(user)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *BaseHandler) sendVerificationEmail(user db.User) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		log.Println("Failed to generate email verification token:", err)
+		return
+	}
+
+	ttl := time.Now().Add(VERIFICATION_TOKEN_TTL_HOURS * time.Hour)
+	if err := db.CreateEmailVerificationToken(h.Conn, user.ID, hashToken(token), ttl); err != nil {
+		log.Println("Failed to store email verification token:", err)
+		return
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by following the link below:\n\n"+
+			"%s/users/verify?token=%s\n\nThe link expires in %d hours.\n",
+			user.Username, h.Config.PublicURL, url.QueryEscape(token), VERIFICATION_TOKEN_TTL_HOURS),
+	}
+	go func() {
+		if err := h.Mailer.Send(msg); err != nil {
+			log.Println("Failed to send email verification email:", err)
+		}
+	}()
+}
+
+// sendEmailChangeToken sends the link confirming the change of the user's email to the new address.
+func (h *BaseHandler) sendEmailChangeToken(user db.User, newEmail string) error {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Now().Add(VERIFICATION_TOKEN_TTL_HOURS * time.Hour)
+	if err := db.CreateEmailChangeToken(h.Conn, user.ID, newEmail, hashToken(token), ttl); err != nil {
+		return err
+	}
+
+	msg := mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm this is your new email address by following the link below:\n\n"+
+			"%s/users/verify?token=%s\n\nThe link expires in %d hours. Until then, your email address remains %s.\n",
+			user.Username, h.Config.PublicURL, url.QueryEscape(token), VERIFICATION_TOKEN_TTL_HOURS, user.Email),
+	}
+	go func() {
+		if err := h.Mailer.Send(msg); err != nil {
+			log.Println("Failed to send email change email:", err)
+		}
+	}()
+	return nil
+}
+
+// sendEmailChangedEmail lets the user know at the old address, in case it was not them.
+func (h *BaseHandler) sendEmailChangedEmail(change db.EmailChange) {
+	msg := mailer.Message{
+		To:      change.OldEmail,
+		Subject: "Your email address has been changed",
+		Body: fmt.Sprintf("Hello,\n\nThe email address of your account has been changed to %s. If it was not you, "+
+			"please let us know right away.\n", change.NewEmail),
+	}
+	go func() {
+		if err := h.Mailer.Send(msg); err != nil {
+			log.Println("Failed to send email changed email:", err)
+		}
+	}()
+}
+
+// requireVerifiedEmail responds with 403 and returns false if the policy does not let
+// the requester perform write actions before verifying their email.
+func (h *BaseHandler) requireVerifiedEmail(w http.ResponseWriter, authReq *AuthenticatedRequest) bool {
+	if authReq.user.EmailVerified || h.Config.UnverifiedUsersPolicy == UNVERIFIED_POLICY_ALLOW {
+		return true
+	}
+	http.Error(w, "Email address not verified.", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	API_KEY_KIND_ADMIN    = "api_key"
+	API_KEY_KIND_PERSONAL = "personal"
+)
+
+const (
+	apiKeyColumns = "id, created_at, owner, kind, name, prefix, scopes, expires_at, last_used_at, revoked_at"
+
+	createApiKeyStmt = `
+	INSERT INTO api_keys (owner, created_by, kind, name, prefix, key_hash, scopes, expires_at) 
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING ` + apiKeyColumns + `;`
+
+	getAllApiKeysStmt = "SELECT " + apiKeyColumns + " FROM api_keys ORDER BY created_at DESC"
+
+	getApiKeysOfOwnerStmt = "SELECT " + apiKeyColumns + " FROM api_keys WHERE owner=$1 AND kind=$2 ORDER BY created_at DESC"
+
+	countUsableApiKeysOfOwnerStmt = `
+	SELECT count(*) FROM api_keys 
+	WHERE owner=$1 AND kind=$2 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now());`
+
+	revokeApiKeyStmt = "UPDATE api_keys SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL"
+
+	revokeApiKeyOfOwnerStmt = "UPDATE api_keys SET revoked_at=now() WHERE id=$1 AND owner=$2 AND kind=$3 AND revoked_at IS NULL"
+
+	// Looking a key up counts as using it. Personal access tokens die with the other tokens of their
+	// owner, e.g. on a password reset, whereas the keys of the admins outlive them.
+	useApiKeyStmt = `
+	UPDATE api_keys k SET last_used_at=now() FROM users u
+	WHERE k.key_hash=$1 AND k.revoked_at IS NULL AND (k.expires_at IS NULL OR k.expires_at > now()) 
+	AND u.id=k.owner AND u.deactivated_at IS NULL
+	AND (k.kind<>'personal' OR u.tokens_valid_after IS NULL OR k.created_at >= u.tokens_valid_after)
+	RETURNING k.id, k.scopes, u.id, u.username, u.email, u.role, 
+	u.email_verified_at IS NOT NULL, u.totp_enabled_at IS NOT NULL, true;`
+)
+
+type ApiKey struct {
+	ID         int        `json:"id"`
+	CrtdAt     time.Time  `json:"created_at"`
+	Owner      int        `json:"owner"`
+	Kind       string     `json:"kind"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanApiKey(row rowScanner) (key ApiKey, err error) {
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err = row.Scan(&key.ID, &key.CrtdAt, &key.Owner, &key.Kind, &key.Name, &key.Prefix, pq.Array(&key.Scopes),
+		&expiresAt, &lastUsedAt, &revokedAt)
+	key.ExpiresAt = nullableTime(expiresAt)
+	key.LastUsedAt = nullableTime(lastUsedAt)
+	key.RevokedAt = nullableTime(revokedAt)
+	return key, err
+}
+
+func nullableTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func CreateApiKey(conn *sql.DB, owner, createdBy int, kind, name, prefix, keyHash string,
+	scopes []string, expiresAt *time.Time) (ApiKey, error) {
+	return scanApiKey(conn.QueryRow(createApiKeyStmt, owner, createdBy, kind, name, prefix, keyHash,
+		pq.Array(scopes), expiresAt))
+}
+
+func GetAllApiKeys(conn *sql.DB) ([]ApiKey, error) {
+	return queryApiKeys(conn, getAllApiKeysStmt)
+}
+
+// GetApiKeysOfOwner returns the keys of the kind owned by the user, the revoked and expired included.
+func GetApiKeysOfOwner(conn *sql.DB, owner int, kind string) ([]ApiKey, error) {
+	return queryApiKeys(conn, getApiKeysOfOwnerStmt, owner, kind)
+}
+
+// CountUsableApiKeysOfOwner counts the keys of the kind owned by the user that can still be used.
+func CountUsableApiKeysOfOwner(conn *sql.DB, owner int, kind string) (count int, err error) {
+	err = conn.QueryRow(countUsableApiKeysOfOwnerStmt, owner, kind).Scan(&count)
+	return count, err
+}
+
+func queryApiKeys(conn *sql.DB, query string, args ...interface{}) ([]ApiKey, error) {
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []ApiKey{}
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func RevokeApiKey(conn *sql.DB, id string) bool {
+	exeResults, err := conn.Exec(revokeApiKeyStmt, id)
+	if err != nil {
+		return false
+	}
+
+	if rowsAffected, _ := exeResults.RowsAffected(); rowsAffected == 0 {
+		return false
+	}
+
+	return true
+}
+
+// RevokeApiKeyOfOwner revokes the key only if it is of the kind and owned by the user.
+func RevokeApiKeyOfOwner(conn *sql.DB, id string, owner int, kind string) bool {
+	exeResults, err := conn.Exec(revokeApiKeyOfOwnerStmt, id, owner, kind)
+	if err != nil {
+		return false
+	}
+
+	if rowsAffected, _ := exeResults.RowsAffected(); rowsAffected == 0 {
+		return false
+	}
+
+	return true
+}
+
+// UseApiKey returns the key's id and scopes along with its owner, provided the key
+// is neither revoked nor expired and the owner has not been deactivated. A personal
+// access token must moreover be younger than the latest revocation of its owner's tokens.
+func UseApiKey(conn *sql.DB, keyHash string) (keyID int, scopes []string, owner User, err error) {
+	err = conn.QueryRow(useApiKeyStmt, keyHash).Scan(&keyID, pq.Array(&scopes),
+		&owner.ID, &owner.Username, &owner.Email, &owner.Role,
+		&owner.EmailVerified, &owner.TotpEnabled, &owner.Active)
+	return keyID, scopes, owner, err
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUseApiKeyAfterPasswordReset(t *testing.T) {
+	conn := openTestDB(t)
+	owner := createTestUser(t, conn)
+
+	suffix := time.Now().UnixNano()
+	personal := fmt.Sprintf("personal-%d", suffix)
+	admin := fmt.Sprintf("admin-%d", suffix)
+	for kind, keyHash := range map[string]string{API_KEY_KIND_PERSONAL: personal, API_KEY_KIND_ADMIN: admin} {
+		if _, err := CreateApiKey(conn, owner, owner, kind, kind, kind, keyHash, []string{"tickets:read"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := UseApiKey(conn, keyHash); err != nil {
+			t.Fatalf("%s key refused before the reset: %v", kind, err)
+		}
+	}
+
+	resetToken := fmt.Sprintf("reset-%d", suffix)
+	if err := CreatePasswordResetToken(conn, owner, resetToken, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResetPassword(conn, resetToken, "new hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := UseApiKey(conn, personal); err != sql.ErrNoRows {
+		t.Errorf("personal token after the reset: got %v, want %v", err, sql.ErrNoRows)
+	}
+	if _, _, _, err := UseApiKey(conn, admin); err != nil {
+		t.Errorf("admin key refused after the reset: %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+const (
+	AUDIT_IMPERSONATION_START   = "impersonation.start"
+	AUDIT_IMPERSONATION_REQUEST = "impersonation.request"
+	AUDIT_USER_DEACTIVATE       = "user.deactivate"
+	AUDIT_USER_REACTIVATE       = "user.reactivate"
+	AUDIT_USER_UPDATE           = "user.update"
+	AUDIT_USER_EXPORT           = "user.export"
+	AUDIT_USER_ERASE            = "user.erase"
+	AUDIT_API_KEY_CREATE        = "api_key.create"
+)
+
+const addAuditRecordStmt = `
+	INSERT INTO audit_log (actor_id, subject_id, action, details) 
+	VALUES ($1, $2, $3, $4);`
+
+// AddAuditRecord records the action taken by the actor on the subject. details is stored
+// as json.
+func AddAuditRecord(conn *sql.DB, actorID, subjectID int, action string, details interface{}) error {
+	detailsJson, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(addAuditRecordStmt, actorID, subjectID, action, string(detailsJson))
+	return err
+}
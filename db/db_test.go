@@ -0,0 +1,39 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// openTestDB connects to the database named by TEST_DB_NAME, on the server of the DB_* envvars,
+// and skips the test if it is not set. The database is not cleaned up afterwards.
+func openTestDB(t *testing.T) *sql.DB {
+	name := os.Getenv("TEST_DB_NAME")
+	if name == "" {
+		t.Skip("TEST_DB_NAME not set")
+	}
+	dsn := NewDSNFromEnv()
+	dsn.DATABASE = name
+	conn, err := Initialize(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err = CreateRelations(conn); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// createTestUser creates a customer whose email is unique to the test run.
+func createTestUser(t *testing.T, conn *sql.DB) int {
+	email := fmt.Sprintf("user-%d@example.com", time.Now().UnixNano())
+	id, err := CreateUser(conn, email, "hash", t.Name(), ROLE_CUSTOMER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	invalidateEmailVerificationTokensStmt = `
+	UPDATE email_verification_tokens SET used_at=now() 
+	WHERE user_id=$1 AND used_at IS NULL;`
+
+	createEmailVerificationTokenStmt = `
+	INSERT INTO email_verification_tokens (user_id, token_hash, expires_at, new_email) 
+	VALUES ($1, $2, $3, $4);`
+
+	getEmailVerificationTokenForUpdateStmt = `
+	SELECT user_id, expires_at, used_at, new_email FROM email_verification_tokens 
+	WHERE token_hash=$1 FOR UPDATE;`
+
+	useEmailVerificationTokenStmt = "UPDATE email_verification_tokens SET used_at=now() WHERE token_hash=$1"
+
+	setEmailVerifiedStmt = "UPDATE users SET email_verified_at=now() WHERE id=$1 AND email_verified_at IS NULL"
+
+	getEmailForUpdateStmt = "SELECT email FROM users WHERE id=$1 FOR UPDATE"
+
+	// The tokens carry the email, the ones issued so far have to be replaced.
+	changeEmailStmt = `
+	UPDATE users SET email=$2, email_verified_at=now(), tokens_valid_after=now() 
+	WHERE id=$1;`
+)
+
+var (
+	ErrVerificationTokenInvalid = errors.New("email verification token invalid")
+	ErrEmailTaken               = errors.New("email address already registered")
+)
+
+// EmailChange is the change of the user's email confirmed with a verification token.
+type EmailChange struct {
+	UserID   int
+	OldEmail string
+	NewEmail string
+}
+
+// CreateEmailVerificationToken stores a new verification token for the user,
+// invalidating the ones sent earlier.
+func CreateEmailVerificationToken(conn *sql.DB, userID int, tokenHash string, expiresAt time.Time) error {
+	return createEmailVerificationToken(conn, userID, tokenHash, expiresAt, nil)
+}
+
+// CreateEmailChangeToken stores a token confirming the change of the user's email to newEmail,
+// invalidating the verification tokens sent earlier.
+func CreateEmailChangeToken(conn *sql.DB, userID int, newEmail, tokenHash string, expiresAt time.Time) error {
+	return createEmailVerificationToken(conn, userID, tokenHash, expiresAt, &newEmail)
+}
+
+func createEmailVerificationToken(conn *sql.DB, userID int, tokenHash string, expiresAt time.Time,
+	newEmail *string) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(invalidateEmailVerificationTokensStmt, userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(createEmailVerificationTokenStmt, userID, tokenHash, expiresAt, newEmail); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VerifyEmail marks the email of the user the token has been sent to as verified or, if the token
+// confirms an email change, changes the email. In the latter case, the change is returned.
+func VerifyEmail(conn *sql.DB, tokenHash string) (change EmailChange, err error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return change, err
+	}
+	defer tx.Rollback()
+
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	var newEmail sql.NullString
+	err = tx.QueryRow(getEmailVerificationTokenForUpdateStmt, tokenHash).Scan(&change.UserID, &expiresAt, &usedAt, &newEmail)
+	if err == sql.ErrNoRows {
+		return change, ErrVerificationTokenInvalid
+	}
+	if err != nil {
+		return change, err
+	}
+	if usedAt.Valid || expiresAt.Before(time.Now()) {
+		return change, ErrVerificationTokenInvalid
+	}
+
+	if _, err = tx.Exec(useEmailVerificationTokenStmt, tokenHash); err != nil {
+		return change, err
+	}
+	if !newEmail.Valid {
+		if _, err = tx.Exec(setEmailVerifiedStmt, change.UserID); err != nil {
+			return change, err
+		}
+		return EmailChange{}, tx.Commit()
+	}
+
+	if err = tx.QueryRow(getEmailForUpdateStmt, change.UserID).Scan(&change.OldEmail); err != nil {
+		return change, err
+	}
+	change.NewEmail = newEmail.String
+	if _, err = tx.Exec(changeEmailStmt, change.UserID, change.NewEmail); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == UNIQUE_VIOLATION_ERR_CODE_NAME {
+			return change, ErrEmailTaken
+		}
+		return change, err
+	}
+	return change, tx.Commit()
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	ERASED_USERNAME = "Erased user"
+	ERASED_TEXT     = "[erased]"
+
+	lockUserForErasureStmt = "SELECT email, username, erased_at IS NOT NULL FROM users WHERE id=$1 FOR UPDATE"
+
+	// The row stays for the tickets and messages to keep their author, as a tombstone nobody
+	// can log in as or reach.
+	eraseUserStmt = `
+	UPDATE users SET email=$2, username=$3, password=$4, email_verified_at=NULL,
+	totp_secret=NULL, totp_enabled_at=NULL, totp_last_step=NULL, oidc_issuer=NULL, oidc_subject=NULL,
+	locale='en', notify_login_alerts=false, deactivated_at=COALESCE(deactivated_at, now()),
+	tokens_valid_after=now(), erased_at=now()
+	WHERE id=$1;`
+
+	// The texts written by the user and the ones written to them on their tickets.
+	getTextsOfUserStmt = `
+	SELECT m.id, m.text FROM messages m JOIN tickets t ON t.id = m.ticket
+	WHERE (t.author_id=$1 OR m.author_id=$1) AND m.text IS NOT NULL;`
+
+	getTopicsOfUserStmt = "SELECT id, topic FROM tickets WHERE author_id=$1"
+
+	setMessageTextStmt = "UPDATE messages SET text=$2 WHERE id=$1"
+
+	// The topics are 20 characters at most, the scrubbed ones may be longer.
+	setTicketTopicStmt = "UPDATE tickets SET topic=left($2, 20) WHERE id=$1"
+
+	countTicketsOfUserStmt = "SELECT count(*) FROM tickets WHERE author_id=$1"
+
+	// The attempts with the email before the user has been registered included.
+	deleteLoginEventsOfUserStmt = "DELETE FROM login_events WHERE user_id=$1 OR lower(email)=lower($2)"
+
+	// The details of the actions taken on the user may hold their old username or other data, who
+	// did what and when stays.
+	redactAuditRecordsOfUserStmt = `
+	UPDATE audit_log SET details='{"redacted": true}'
+	WHERE subject_id=$1 AND details <> '{}' AND details <> '{"redacted": true}';`
+)
+
+// The personal data left behind by the user, apart from the user row and the texts.
+var erasePersonalDataStmts = []string{
+	"DELETE FROM refresh_tokens WHERE user_id=$1",
+	"DELETE FROM password_reset_tokens WHERE user_id=$1",
+	"DELETE FROM email_verification_tokens WHERE user_id=$1",
+	"DELETE FROM recovery_codes WHERE user_id=$1",
+	"DELETE FROM api_keys WHERE owner=$1",
+}
+
+var (
+	ErrUserErased = errors.New("user erased")
+
+	emailAddressRegex = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+)
+
+// Erasure tells what has been erased, the email is the one the user had.
+type Erasure struct {
+	Email                string `json:"-"`
+	TicketsKept          int    `json:"tickets_kept"`
+	MessagesScrubbed     int    `json:"messages_scrubbed"`
+	TopicsScrubbed       int    `json:"topics_scrubbed"`
+	AuditRecordsRedacted int    `json:"audit_records_redacted"`
+}
+
+// EraseUser replaces the personal data of the user with a tombstone identity and deletes the
+// rest, while their tickets and messages are kept, with the email addresses and the name of the
+// user taken out of the texts. The statuses and dates of the tickets stay as they are, as do the
+// actions and dates of the audit records on the user, whose details are redacted.
+func EraseUser(conn *sql.DB, id int, noPasswordHash string) (erasure Erasure, err error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return erasure, err
+	}
+	defer tx.Rollback()
+
+	var username string
+	var erased bool
+	if err = tx.QueryRow(lockUserForErasureStmt, id).Scan(&erasure.Email, &username, &erased); err != nil {
+		return erasure, err
+	}
+	if erased {
+		return erasure, ErrUserErased
+	}
+
+	scrub := newScrubber(erasure.Email, username)
+	if erasure.MessagesScrubbed, err = scrubTexts(tx, getTextsOfUserStmt, setMessageTextStmt, id, scrub); err != nil {
+		return erasure, err
+	}
+	if erasure.TopicsScrubbed, err = scrubTexts(tx, getTopicsOfUserStmt, setTicketTopicStmt, id, scrub); err != nil {
+		return erasure, err
+	}
+	if err = tx.QueryRow(countTicketsOfUserStmt, id).Scan(&erasure.TicketsKept); err != nil {
+		return erasure, err
+	}
+
+	if _, err = tx.Exec(deleteLoginEventsOfUserStmt, id, erasure.Email); err != nil {
+		return erasure, err
+	}
+	redacted, err := tx.Exec(redactAuditRecordsOfUserStmt, id)
+	if err != nil {
+		return erasure, err
+	}
+	redactedCount, err := redacted.RowsAffected()
+	if err != nil {
+		return erasure, err
+	}
+	erasure.AuditRecordsRedacted = int(redactedCount)
+	for _, stmt := range erasePersonalDataStmts {
+		if _, err = tx.Exec(stmt, id); err != nil {
+			return erasure, err
+		}
+	}
+
+	tombstone := fmt.Sprintf("erased-%d@erased.invalid", id)
+	if _, err = tx.Exec(eraseUserStmt, id, tombstone, ERASED_USERNAME, noPasswordHash); err != nil {
+		return erasure, err
+	}
+	return erasure, tx.Commit()
+}
+
+// scrubTexts rewrites the texts selected by the query that the scrubbing changes. The changes are
+// collected first, since the connection cannot update while still reading the rows.
+func scrubTexts(tx *sql.Tx, query, update string, userID int, scrub func(string) string) (int, error) {
+	rows, err := tx.Query(query, userID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	changed := map[int]string{}
+	for rows.Next() {
+		var id int
+		var text string
+		if err := rows.Scan(&id, &text); err != nil {
+			return 0, err
+		}
+		if scrubbed := scrub(text); scrubbed != text {
+			changed[id] = scrubbed
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	for id, text := range changed {
+		if _, err := tx.Exec(update, id, text); err != nil {
+			return 0, err
+		}
+	}
+	return len(changed), nil
+}
+
+// newScrubber returns what replaces any email address, the username and the parts of it, as long
+// as they have 3 or more letters, as whole words and whatever the case, with ERASED_TEXT. Shorter
+// ones would wipe out common words along with them.
+func newScrubber(email, username string) func(string) string {
+	var names []string
+	// The whole name first, so it is replaced at once rather than part by part.
+	for _, name := range append([]string{strings.TrimSpace(username)}, strings.Fields(username)...) {
+		if len([]rune(name)) >= 3 {
+			names = append(names, regexp.QuoteMeta(name))
+		}
+	}
+	var nameRegex *regexp.Regexp
+	if len(names) > 0 {
+		nameRegex = regexp.MustCompile(`(?i)(^|[^\p{L}\p{N}_])(` + strings.Join(names, "|") + `)([^\p{L}\p{N}_]|$)`)
+	}
+
+	return func(text string) string {
+		text = strings.ReplaceAll(text, email, ERASED_TEXT)
+		text = emailAddressRegex.ReplaceAllString(text, ERASED_TEXT)
+		if nameRegex == nil {
+			return text
+		}
+		// The matches cannot share the character between them, the names right next to each
+		// other take a second pass.
+		for pass := 0; pass < 2; pass++ {
+			text = nameRegex.ReplaceAllString(text, "${1}"+ERASED_TEXT+"${3}")
+		}
+		return text
+	}
+}
@@ -0,0 +1,34 @@
+package db
+
+import "testing"
+
+func TestScrubber(t *testing.T) {
+	cases := []struct {
+		name     string
+		email    string
+		username string
+		text     string
+		scrubbed string
+	}{
+		{"own email", "jo.doe@mail.io", "jo", "write to jo.doe@mail.io", "write to [erased]"},
+		{"other emails", "jo.doe@mail.io", "jo", "cc Jane.Roe+x@corp.co.uk, ok?", "cc [erased], ok?"},
+		{"own email in capitals", "jo.doe@mail.io", "jo", "JO.DOE@MAIL.IO", "[erased]"},
+		{"single name", "u@mail.io", "Robert", "Thanks, robert!", "Thanks, [erased]!"},
+		{"name inside a word", "u@mail.io", "Rob", "the robbery", "the robbery"},
+		{"multi-part name at once", "u@mail.io", "Mary Ann Lee", "I am Mary Ann Lee.", "I am [erased]."},
+		{"parts of the name", "u@mail.io", "Mary Ann Lee", "Ann here, Lee too", "[erased] here, [erased] too"},
+		{"adjacent names", "u@mail.io", "Mary Ann", "Ann Ann Mary Mary", "[erased] [erased] [erased] [erased]"},
+		{"short parts kept", "u@mail.io", "Al Bo Cy", "Al said Bo and Cy left", "Al said Bo and Cy left"},
+		{"short whole name kept", "u@mail.io", "Al", "Al is in Alabama", "Al is in Alabama"},
+		{"whole name of short parts", "u@mail.io", "Al Bo", "al bo here, Al there", "[erased] here, Al there"},
+		{"letters counted, not bytes", "u@mail.io", "Ål", "Ål is back", "Ål is back"},
+		{"non-latin name", "u@mail.io", "Ёжик", "привет, ёжик", "привет, [erased]"},
+		{"blank name", "u@mail.io", "  ", "nothing  to do", "nothing  to do"},
+		{"regex characters", "u@mail.io", "a.b*c", "a.b*c and axbbc", "[erased] and axbbc"},
+	}
+	for _, c := range cases {
+		if got := newScrubber(c.email, c.username)(c.text); got != c.scrubbed {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.scrubbed)
+		}
+	}
+}
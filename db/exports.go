@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// EXPORT_LOCK_CLASS tells the advisory locks of the exports apart from any others, the user id
+// being the other half of the key.
+const EXPORT_LOCK_CLASS = 1
+
+const (
+	// Held until the transaction ends, by whichever instance of the service runs the export.
+	lockExportStmt = "SELECT pg_try_advisory_xact_lock($1, $2)"
+
+	exportTicketsStmt = `
+	SELECT id, created_at, updated_at, topic, status FROM tickets WHERE author_id=$1 ORDER BY id;`
+
+	// The messages written by the user and the ones written to them on their tickets.
+	exportMessagesStmt = `
+	SELECT m.id, m.created_at, m.ticket, m.type, m.text, m.author_id IS NOT DISTINCT FROM $1 
+	FROM messages m JOIN tickets t ON t.id = m.ticket 
+	WHERE t.author_id=$1 OR m.author_id=$1 ORDER BY m.id;`
+
+	exportLoginEventsStmt = "SELECT " + loginEventColumns + " FROM login_events WHERE user_id=$1 ORDER BY id"
+)
+
+// ExportedMessage is a message on one of the user's tickets or written by the user. The authors
+// other than the user are not disclosed.
+type ExportedMessage struct {
+	ID     int       `json:"id"`
+	CrtdAt time.Time `json:"created_at"`
+	Ticket int       `json:"ticket"`
+	Type   string    `json:"type"`
+	Text   string    `json:"text"`
+	Own    bool      `json:"own"`
+}
+
+// Export reads all the data of a user from a single snapshot of the database, row by row,
+// so that it can be streamed whatever its size.
+type Export struct {
+	ctx    context.Context
+	tx     *sql.Tx
+	userID int
+}
+
+var ErrExportUnderway = errors.New("an export of the user is already underway")
+
+// BeginExport starts the export of the user, ErrExportUnderway if one is running already. The
+// export holds a connection until closed, or until ctx is done, which rolls it back.
+func BeginExport(ctx context.Context, conn *sql.DB, userID int) (*Export, error) {
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+	if err = tx.QueryRowContext(ctx, lockExportStmt, EXPORT_LOCK_CLASS, userID).Scan(&locked); err != nil || !locked {
+		tx.Rollback()
+		if err == nil {
+			err = ErrExportUnderway
+		}
+		return nil, err
+	}
+	return &Export{ctx, tx, userID}, nil
+}
+
+func (e *Export) Close() error {
+	return e.tx.Rollback()
+}
+
+// Profile returns the user as of the snapshot, sql.ErrNoRows if there is no such user.
+func (e *Export) Profile() (Profile, error) {
+	return getProfile(e.tx, e.userID)
+}
+
+func (e *Export) Tickets(each func(Ticket) error) error {
+	return e.eachRow(exportTicketsStmt, func(rows *sql.Rows) error {
+		var t Ticket
+		if err := rows.Scan(&t.ID, &t.CrtdAt, &t.UpdAt, &t.Topic, &t.Status); err != nil {
+			return err
+		}
+		return each(t)
+	})
+}
+
+func (e *Export) Messages(each func(ExportedMessage) error) error {
+	return e.eachRow(exportMessagesStmt, func(rows *sql.Rows) error {
+		var m ExportedMessage
+		var text sql.NullString
+		if err := rows.Scan(&m.ID, &m.CrtdAt, &m.Ticket, &m.Type, &text, &m.Own); err != nil {
+			return err
+		}
+		m.Text = text.String
+		return each(m)
+	})
+}
+
+func (e *Export) LoginEvents(each func(LoginEvent) error) error {
+	return e.eachRow(exportLoginEventsStmt, func(rows *sql.Rows) error {
+		var l LoginEvent
+		if err := rows.Scan(&l.ID, &l.CrtdAt, &l.IP, &l.UserAgent, &l.Method, &l.Outcome); err != nil {
+			return err
+		}
+		return each(l)
+	})
+}
+
+func (e *Export) eachRow(query string, scan func(*sql.Rows) error) error {
+	rows, err := e.tx.QueryContext(e.ctx, query, e.userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
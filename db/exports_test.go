@@ -0,0 +1,31 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBeginExportOneAtATime(t *testing.T) {
+	conn := openTestDB(t)
+	userID := createTestUser(t, conn)
+
+	first, err := BeginExport(context.Background(), conn, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = BeginExport(context.Background(), conn, userID); err != ErrExportUnderway {
+		t.Errorf("second export: got %v, want %v", err, ErrExportUnderway)
+	}
+	other, err := BeginExport(context.Background(), conn, createTestUser(t, conn))
+	if err != nil {
+		t.Fatalf("export of another user: %v", err)
+	}
+	other.Close()
+
+	first.Close()
+	again, err := BeginExport(context.Background(), conn, userID)
+	if err != nil {
+		t.Fatalf("export after the first one: %v", err)
+	}
+	again.Close()
+}
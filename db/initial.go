@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"db-queries/env"
 	"fmt"
 	"log"
 
@@ -13,7 +14,6 @@ type DSN struct {
 }
 
 const (
-	enableCryptoStmt     = "CREATE EXTENSION IF NOT EXISTS pgcrypto;"
 	createTableUsersStmt = `
 	CREATE TABLE IF NOT EXISTS users
 	(
@@ -22,10 +22,36 @@ const (
 		email VARCHAR(64) NOT NULL UNIQUE,
 		password TEXT NOT NULL,
 		username VARCHAR(64) NOT NULL,
-		is_staff BOOLEAN DEFAULT FALSE,
-		is_superuser BOOLEAN DEFAULT FALSE,
+		role VARCHAR(32) NOT NULL DEFAULT 'customer' REFERENCES roles (name),
 		CONSTRAINT pk_users PRIMARY KEY (id)
 	);`
+	// Accounts registered before email verification was introduced are considered verified.
+	alterTableUsersEmailVerifiedStmt = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP DEFAULT now();
+	ALTER TABLE users ALTER COLUMN email_verified_at DROP DEFAULT;`
+	alterTableUsersTotpStmt = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMP;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT;`
+	// Tokens issued before tokens_valid_after are rejected even if not expired yet.
+	alterTableUsersDeactivationStmt = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMP;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS tokens_valid_after TIMESTAMP;`
+	// The identity at the OpenID Connect provider the user logs in with, if any.
+	alterTableUsersOIDCStmt = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_issuer TEXT;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject TEXT;
+	CREATE UNIQUE INDEX IF NOT EXISTS users_oidc_identity_idx ON users (oidc_issuer, oidc_subject);`
+	alterTableUsersPreferencesStmt = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS locale VARCHAR(16) NOT NULL DEFAULT 'en';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS notify_login_alerts BOOLEAN NOT NULL DEFAULT true;`
+	// An erased user is a tombstone kept for the tickets and messages to still have an author.
+	alterTableUsersErasureStmt = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS erased_at TIMESTAMP;`
+	// The list of users is filtered by the date of registration and the role.
+	createUsersListIndexesStmt = `
+	CREATE INDEX IF NOT EXISTS users_created_at_idx ON users (created_at);
+	CREATE INDEX IF NOT EXISTS users_role_idx ON users (role);`
 	createStatusTypeStmt = `
 	CREATE OR REPLACE FUNCTION create_types() RETURNS integer AS $$
 	DECLARE type_already_exists INTEGER;
@@ -50,10 +76,11 @@ const (
 		id SERIAL,
 		created_at TIMESTAMP DEFAULT now(),
 		updated_at TIMESTAMP DEFAULT now(),
-		author VARCHAR(64) REFERENCES users (email) ON DELETE CASCADE,
+		author_id INTEGER,
 		topic VARCHAR(20) NOT NULL,
 		status STATUS,
-		CONSTRAINT pk_tickets PRIMARY KEY (id)
+		CONSTRAINT pk_tickets PRIMARY KEY (id),
+		CONSTRAINT fk_tickets_author FOREIGN KEY (author_id) REFERENCES users (id) ON DELETE RESTRICT
 	);`
 
 	createTableMessagesStmt = `
@@ -62,11 +89,176 @@ const (
 		id SERIAL,
 		created_at TIMESTAMP DEFAULT now(),
 		type MSG_TYPE,
-		author VARCHAR(64) REFERENCES users (email) ON DELETE CASCADE,
+		author_id INTEGER,
 		text TEXT,
 		ticket INTEGER REFERENCES tickets (id) ON DELETE CASCADE,
-		CONSTRAINT pk_messages PRIMARY KEY (id)
+		CONSTRAINT pk_messages PRIMARY KEY (id),
+		CONSTRAINT fk_messages_author FOREIGN KEY (author_id) REFERENCES users (id) ON DELETE RESTRICT
 	);`
+
+	// The tickets and messages used to reference the email of their author, which kept the
+	// emails from ever changing.
+	migrateAuthorsToUserIdsStmt = `
+	DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name='tickets' AND column_name='author') THEN
+			ALTER TABLE tickets ADD COLUMN author_id INTEGER;
+			UPDATE tickets t SET author_id = u.id FROM users u WHERE u.email = t.author;
+			ALTER TABLE tickets DROP COLUMN author;
+			ALTER TABLE tickets ADD CONSTRAINT fk_tickets_author 
+				FOREIGN KEY (author_id) REFERENCES users (id) ON DELETE RESTRICT;
+		END IF;
+		IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name='messages' AND column_name='author') THEN
+			ALTER TABLE messages ADD COLUMN author_id INTEGER;
+			UPDATE messages m SET author_id = u.id FROM users u WHERE u.email = m.author;
+			ALTER TABLE messages DROP COLUMN author;
+			ALTER TABLE messages ADD CONSTRAINT fk_messages_author 
+				FOREIGN KEY (author_id) REFERENCES users (id) ON DELETE RESTRICT;
+		END IF;
+	END $$;
+	CREATE INDEX IF NOT EXISTS tickets_author_id_idx ON tickets (author_id);
+	CREATE INDEX IF NOT EXISTS messages_author_id_idx ON messages (author_id);`
+
+	// Deleting a user used to delete their tickets and messages along, the support history
+	// is now kept: users are erased instead.
+	restrictAuthorDeletionStmt = `
+	DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname='fk_tickets_author' AND confdeltype='c') THEN
+			ALTER TABLE tickets DROP CONSTRAINT fk_tickets_author, ADD CONSTRAINT fk_tickets_author 
+				FOREIGN KEY (author_id) REFERENCES users (id) ON DELETE RESTRICT;
+		END IF;
+		IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname='fk_messages_author' AND confdeltype='c') THEN
+			ALTER TABLE messages DROP CONSTRAINT fk_messages_author, ADD CONSTRAINT fk_messages_author 
+				FOREIGN KEY (author_id) REFERENCES users (id) ON DELETE RESTRICT;
+		END IF;
+	END $$;`
+
+	createTableRefreshTokensStmt = `
+	CREATE TABLE IF NOT EXISTS refresh_tokens
+	(
+		id SERIAL,
+		created_at TIMESTAMP DEFAULT now(),
+		user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+		session_id VARCHAR(64) NOT NULL,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP,
+		CONSTRAINT pk_refresh_tokens PRIMARY KEY (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session ON refresh_tokens (session_id);`
+	// The hash of the csrf token issued along with the refresh token, see RotateRefreshToken.
+	alterTableRefreshTokensCSRFStmt = `
+	ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS csrf_hash VARCHAR(64);`
+
+	createTableRevokedTokensStmt = `
+	CREATE TABLE IF NOT EXISTS revoked_tokens
+	(
+		jti VARCHAR(64),
+		expires_at TIMESTAMP NOT NULL,
+		CONSTRAINT pk_revoked_tokens PRIMARY KEY (jti)
+	);`
+
+	createTablePasswordResetTokensStmt = `
+	CREATE TABLE IF NOT EXISTS password_reset_tokens
+	(
+		id SERIAL,
+		created_at TIMESTAMP DEFAULT now(),
+		user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		CONSTRAINT pk_password_reset_tokens PRIMARY KEY (id)
+	);`
+
+	createTableEmailVerificationTokensStmt = `
+	CREATE TABLE IF NOT EXISTS email_verification_tokens
+	(
+		id SERIAL,
+		created_at TIMESTAMP DEFAULT now(),
+		user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		CONSTRAINT pk_email_verification_tokens PRIMARY KEY (id)
+	);`
+	// A token with new_email confirms the change of the user's email to it.
+	alterTableEmailVerificationTokensStmt = `
+	ALTER TABLE email_verification_tokens ADD COLUMN IF NOT EXISTS new_email VARCHAR(64);`
+
+	createTableLoginThrottlesStmt = `
+	CREATE TABLE IF NOT EXISTS login_throttles
+	(
+		key VARCHAR(128),
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at TIMESTAMP NOT NULL DEFAULT now(),
+		locked_until TIMESTAMP,
+		CONSTRAINT pk_login_throttles PRIMARY KEY (key)
+	);`
+
+	createTableRecoveryCodesStmt = `
+	CREATE TABLE IF NOT EXISTS recovery_codes
+	(
+		id SERIAL,
+		created_at TIMESTAMP DEFAULT now(),
+		user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+		code_hash VARCHAR(64) NOT NULL,
+		used_at TIMESTAMP,
+		CONSTRAINT pk_recovery_codes PRIMARY KEY (id)
+	);`
+
+	createTableApiKeysStmt = `
+	CREATE TABLE IF NOT EXISTS api_keys
+	(
+		id SERIAL,
+		created_at TIMESTAMP DEFAULT now(),
+		owner INTEGER REFERENCES users (id) ON DELETE CASCADE,
+		created_by INTEGER REFERENCES users (id) ON DELETE SET NULL,
+		name VARCHAR(64) NOT NULL,
+		prefix VARCHAR(16) NOT NULL,
+		key_hash VARCHAR(64) NOT NULL UNIQUE,
+		scopes TEXT[] NOT NULL,
+		expires_at TIMESTAMP,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		CONSTRAINT pk_api_keys PRIMARY KEY (id)
+	);`
+	// Personal access tokens are the keys the users create for themselves.
+	alterTableApiKeysKindStmt = `
+	ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS kind VARCHAR(16) NOT NULL DEFAULT 'api_key';
+	CREATE INDEX IF NOT EXISTS api_keys_owner_kind_idx ON api_keys (owner, kind);`
+
+	// The user is the one with the email tried, if any. The device is a hash of the ip and user agent.
+	createTableLoginEventsStmt = `
+	CREATE TABLE IF NOT EXISTS login_events
+	(
+		id SERIAL,
+		created_at TIMESTAMP DEFAULT now(),
+		user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+		email VARCHAR(255) NOT NULL,
+		ip VARCHAR(64) NOT NULL,
+		user_agent VARCHAR(512) NOT NULL,
+		device VARCHAR(64) NOT NULL,
+		method VARCHAR(16) NOT NULL,
+		outcome VARCHAR(32) NOT NULL,
+		CONSTRAINT pk_login_events PRIMARY KEY (id)
+	);
+	CREATE INDEX IF NOT EXISTS login_events_user_id_idx ON login_events (user_id, created_at);
+	CREATE INDEX IF NOT EXISTS login_events_created_at_idx ON login_events (created_at);
+	CREATE INDEX IF NOT EXISTS login_events_user_device_idx ON login_events (user_id, device) WHERE outcome='` + LOGIN_SUCCESS + `';`
+
+	createTableAuditLogStmt = `
+	CREATE TABLE IF NOT EXISTS audit_log
+	(
+		id SERIAL,
+		created_at TIMESTAMP DEFAULT now(),
+		actor_id INTEGER REFERENCES users (id) ON DELETE SET NULL,
+		subject_id INTEGER REFERENCES users (id) ON DELETE SET NULL,
+		action VARCHAR(64) NOT NULL,
+		details JSONB NOT NULL DEFAULT '{}',
+		CONSTRAINT pk_audit_log PRIMARY KEY (id)
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_subject_id_idx ON audit_log (subject_id);`
 	VALUE_TOO_LONG_ERR_CODE_NAME   = "string_data_right_truncation"
 	UNIQUE_VIOLATION_ERR_CODE_NAME = "unique_violation"
 )
@@ -83,6 +275,17 @@ var (
 	}
 )
 
+// NewDSNFromEnv reads the connection settings from the DB_* envvars.
+func NewDSNFromEnv() *DSN {
+	return &DSN{
+		HOST:     env.Get("DB_HOST", "db"),
+		PORT:     env.Get("DB_PORT", "5432"),
+		USERNAME: env.Get("DB_USER", "postgres"),
+		PASSWORD: env.Get("DB_PASSWORD", "postgres"),
+		DATABASE: env.Get("DB_NAME", "tickets"),
+	}
+}
+
 func Initialize(dsn *DSN) (*sql.DB, error) {
 	connString := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		dsn.HOST, dsn.PORT, dsn.USERNAME, dsn.PASSWORD, dsn.DATABASE)
@@ -100,7 +303,13 @@ func Initialize(dsn *DSN) (*sql.DB, error) {
 }
 
 func CreateRelations(conn *sql.DB) (err error) {
-	_, err = conn.Exec(enableCryptoStmt)
+	log.Println("Creating tables 'roles', 'permissions', 'role_permissions' if not exist.")
+	_, err = conn.Exec(createTableRolesStmt)
+	if err != nil {
+		return err
+	}
+
+	err = seedRoles(conn)
 	if err != nil {
 		return err
 	}
@@ -111,6 +320,46 @@ func CreateRelations(conn *sql.DB) (err error) {
 		return err
 	}
 
+	_, err = conn.Exec(migrateUsersToRolesStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(alterTableUsersEmailVerifiedStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(alterTableUsersTotpStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(alterTableUsersDeactivationStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(alterTableUsersOIDCStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(alterTableUsersPreferencesStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(alterTableUsersErasureStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(createUsersListIndexesStmt)
+	if err != nil {
+		return err
+	}
+
 	_, err = conn.Exec(createStatusTypeStmt)
 	if err != nil {
 		return err
@@ -127,5 +376,84 @@ func CreateRelations(conn *sql.DB) (err error) {
 	if err != nil {
 		return err
 	}
+
+	_, err = conn.Exec(migrateAuthorsToUserIdsStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(restrictAuthorDeletionStmt)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating table 'refresh_tokens' if not exists.")
+	_, err = conn.Exec(createTableRefreshTokensStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(alterTableRefreshTokensCSRFStmt)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating table 'revoked_tokens' if not exists.")
+	_, err = conn.Exec(createTableRevokedTokensStmt)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating table 'password_reset_tokens' if not exists.")
+	_, err = conn.Exec(createTablePasswordResetTokensStmt)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating table 'email_verification_tokens' if not exists.")
+	_, err = conn.Exec(createTableEmailVerificationTokensStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(alterTableEmailVerificationTokensStmt)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating table 'login_throttles' if not exists.")
+	_, err = conn.Exec(createTableLoginThrottlesStmt)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating table 'recovery_codes' if not exists.")
+	_, err = conn.Exec(createTableRecoveryCodesStmt)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating table 'api_keys' if not exists.")
+	_, err = conn.Exec(createTableApiKeysStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(alterTableApiKeysKindStmt)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating table 'login_events' if not exists.")
+	_, err = conn.Exec(createTableLoginEventsStmt)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating table 'audit_log' if not exists.")
+	_, err = conn.Exec(createTableAuditLogStmt)
+	if err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	LOGIN_METHOD_PASSWORD = "password"
+	LOGIN_METHOD_MFA      = "mfa"
+	LOGIN_METHOD_OIDC     = "oidc"
+)
+
+const (
+	LOGIN_SUCCESS             = "success"
+	LOGIN_INVALID_CREDENTIALS = "invalid_credentials"
+	LOGIN_INVALID_CODE        = "invalid_code"
+	LOGIN_LOCKED              = "locked"
+	LOGIN_DEACTIVATED         = "deactivated"
+	LOGIN_UNVERIFIED          = "unverified"
+	LOGIN_NO_ROLE             = "no_role"
+)
+
+const (
+	loginEventColumns = "id, created_at, ip, user_agent, method, outcome"
+
+	// Along with the event, tells whether the user has logged in before, and from the device,
+	// and whether they want to be alerted of logins from new devices.
+	// Whether the user has logged in before, and from the device, is looked up in the partial
+	// index of the successful logins, however long the history kept.
+	recordLoginEventStmt = `
+	WITH seen AS (
+		SELECT EXISTS (
+			SELECT 1 FROM login_events 
+			WHERE user_id=(SELECT id FROM users WHERE email=$1) AND outcome='` + LOGIN_SUCCESS + `'
+		) AS logged_in, EXISTS (
+			SELECT 1 FROM login_events 
+			WHERE user_id=(SELECT id FROM users WHERE email=$1) AND outcome='` + LOGIN_SUCCESS + `' AND device=$4
+		) AS device_seen
+	)
+	INSERT INTO login_events (user_id, email, ip, user_agent, device, method, outcome) 
+	VALUES ((SELECT id FROM users WHERE email=$1), $1, $2, $3, $4, $5, $6)
+	RETURNING (SELECT logged_in FROM seen), (SELECT device_seen FROM seen), 
+	COALESCE((SELECT notify_login_alerts FROM users WHERE email=$1), false);`
+
+	purgeLoginEventsStmt = "DELETE FROM login_events WHERE created_at < $1"
+
+	getLoginEventsOfUserStmt = `
+	SELECT ` + loginEventColumns + ` FROM login_events 
+	WHERE user_id=$1 ORDER BY created_at DESC, id DESC LIMIT $2;`
+)
+
+type LoginEvent struct {
+	ID        int       `json:"id"`
+	CrtdAt    time.Time `json:"created_at"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Method    string    `json:"method"`
+	Outcome   string    `json:"outcome"`
+}
+
+// RecordLoginEvent records the attempt to log in with the email, and reports whether it is a
+// successful login of a user that has logged in before, but never from the device, and who
+// wants to be alerted of it.
+func RecordLoginEvent(conn *sql.DB, email, ip, userAgent, device, method, outcome string) (alert bool, err error) {
+	var loggedIn, deviceSeen, notify bool
+	err = conn.QueryRow(recordLoginEventStmt, email, ip, userAgent, device, method, outcome).
+		Scan(&loggedIn, &deviceSeen, &notify)
+	return outcome == LOGIN_SUCCESS && loggedIn && !deviceSeen && notify, err
+}
+
+// PurgeLoginEvents deletes the events older than retainSince and returns how many there were.
+func PurgeLoginEvents(conn *sql.DB, retainSince time.Time) (int64, error) {
+	result, err := conn.Exec(purgeLoginEventsStmt, retainSince)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetLoginEventsOfUser returns the latest login attempts of the user, the latest first.
+func GetLoginEventsOfUser(conn *sql.DB, userID, limit int) ([]LoginEvent, error) {
+	rows, err := conn.Query(getLoginEventsOfUserStmt, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []LoginEvent{}
+	for rows.Next() {
+		var e LoginEvent
+		if err := rows.Scan(&e.ID, &e.CrtdAt, &e.IP, &e.UserAgent, &e.Method, &e.Outcome); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,33 @@
+package db
+
+import "testing"
+
+func TestRecordLoginEventAlert(t *testing.T) {
+	conn := openTestDB(t)
+	user, err := GetUserByID(conn, createTestUser(t, conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		device  string
+		outcome string
+		alert   bool
+	}{
+		{"laptop", LOGIN_SUCCESS, false},
+		{"phone", LOGIN_INVALID_CREDENTIALS, false},
+		{"laptop", LOGIN_SUCCESS, false},
+		{"phone", LOGIN_SUCCESS, true},
+		{"phone", LOGIN_SUCCESS, false},
+	}
+	for i, step := range steps {
+		alert, err := RecordLoginEvent(conn, user.Email, "192.0.2.1", "test", step.device, LOGIN_METHOD_PASSWORD,
+			step.outcome)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alert != step.alert {
+			t.Errorf("step %d, %s from the %s: got alert %v, want %v", i, step.outcome, step.device, alert, step.alert)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	getLockedUntilStmt = `
+	SELECT MAX(locked_until) FROM login_throttles 
+	WHERE key = ANY($1) AND locked_until > now();`
+
+	// The counter starts over once the key has been quiet for longer than the window.
+	registerLoginFailureStmt = `
+	INSERT INTO login_throttles AS t (key, failures, last_failure_at) VALUES ($1, 1, now())
+	ON CONFLICT (key) DO UPDATE SET 
+		failures = CASE WHEN t.last_failure_at < now() - $2 * interval '1 second' THEN 1 ELSE t.failures + 1 END,
+		last_failure_at = now()
+	RETURNING failures;`
+
+	// An attempt reserves the key by locking it until the attempt has been evaluated. A key locked
+	// already is left alone, the row lock taken meanwhile makes the concurrent attempts wait their turn.
+	reserveLoginKeyStmt = `
+	INSERT INTO login_throttles AS t (key, locked_until) VALUES ($1, now() + $2 * interval '1 second')
+	ON CONFLICT (key) DO UPDATE SET locked_until = EXCLUDED.locked_until
+	WHERE t.locked_until IS NULL OR t.locked_until <= now()
+	RETURNING locked_until;`
+
+	releaseLoginKeysStmt = "UPDATE login_throttles SET locked_until=NULL WHERE key = ANY($1) AND locked_until=$2"
+
+	lockLoginKeyStmt = "UPDATE login_throttles SET locked_until=$2 WHERE key=$1"
+
+	clearLoginThrottleStmt = "DELETE FROM login_throttles WHERE key=$1"
+)
+
+// GetLockedUntil returns the time the longest lock on any of the keys ends at,
+// or the zero time if none of them is locked.
+func GetLockedUntil(conn *sql.DB, keys ...string) (time.Time, error) {
+	var lockedUntil sql.NullTime
+	err := conn.QueryRow(getLockedUntilStmt, pq.Array(keys)).Scan(&lockedUntil)
+	return lockedUntil.Time, err
+}
+
+// ReserveLoginKeys locks all the keys for the time an attempt may take to be evaluated, provided
+// none of them is locked yet, and returns the time the reservation ends at. Otherwise nothing is
+// reserved, and the time the longest lock on any of the keys ends at is returned instead.
+func ReserveLoginKeys(conn *sql.DB, hold time.Duration, keys ...string) (reservedUntil, lockedUntil time.Time, err error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return reservedUntil, lockedUntil, err
+	}
+	defer tx.Rollback()
+
+	// The same order everywhere keeps the concurrent reservations from deadlocking.
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		err = tx.QueryRow(reserveLoginKeyStmt, key, int(hold.Seconds())).Scan(&reservedUntil)
+		if err == sql.ErrNoRows {
+			var locked sql.NullTime
+			err = tx.QueryRow(getLockedUntilStmt, pq.Array(keys)).Scan(&locked)
+			return time.Time{}, locked.Time, err
+		}
+		if err != nil {
+			return time.Time{}, lockedUntil, err
+		}
+	}
+	return reservedUntil, lockedUntil, tx.Commit()
+}
+
+// ReleaseLoginKeys unlocks the keys reserved until reservedUntil. The keys locked again since,
+// e.g. after a failure, stay locked.
+func ReleaseLoginKeys(conn *sql.DB, reservedUntil time.Time, keys ...string) error {
+	_, err := conn.Exec(releaseLoginKeysStmt, pq.Array(keys), reservedUntil)
+	return err
+}
+
+// RegisterLoginFailure counts a failed attempt for the key and returns the number of
+// failures within the window so far.
+func RegisterLoginFailure(conn *sql.DB, key string, window time.Duration) (failures int, err error) {
+	err = conn.QueryRow(registerLoginFailureStmt, key, int(window.Seconds())).Scan(&failures)
+	return failures, err
+}
+
+func LockLoginKey(conn *sql.DB, key string, until time.Time) error {
+	_, err := conn.Exec(lockLoginKeyStmt, key, until)
+	return err
+}
+
+func ClearLoginThrottle(conn *sql.DB, key string) error {
+	_, err := conn.Exec(clearLoginThrottleStmt, key)
+	return err
+}
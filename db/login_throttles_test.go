@@ -0,0 +1,67 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReserveLoginKeysConcurrently(t *testing.T) {
+	conn := openTestDB(t)
+	account := fmt.Sprintf("account:%d@example.com", time.Now().UnixNano())
+	ip := fmt.Sprintf("ip:%d", time.Now().UnixNano())
+
+	const attempts = 20
+	reserved := make(chan time.Time, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reservedUntil, lockedUntil, err := ReserveLoginKeys(conn, time.Minute, account, ip)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if reservedUntil.IsZero() {
+				if lockedUntil.IsZero() {
+					t.Error("turned down without a lock")
+				}
+				return
+			}
+			reserved <- reservedUntil
+		}()
+	}
+	wg.Wait()
+	close(reserved)
+
+	if len(reserved) != 1 {
+		t.Fatalf("%d of %d concurrent attempts reserved the keys, want 1", len(reserved), attempts)
+	}
+	if err := ReleaseLoginKeys(conn, <-reserved, account, ip); err != nil {
+		t.Fatal(err)
+	}
+	if reservedUntil, _, err := ReserveLoginKeys(conn, time.Minute, ip); err != nil || reservedUntil.IsZero() {
+		t.Errorf("released key: got %v, %v, want it reserved again", reservedUntil, err)
+	}
+}
+
+func TestReleaseLoginKeysKeepsNewerLock(t *testing.T) {
+	conn := openTestDB(t)
+	key := fmt.Sprintf("account:%d@example.com", time.Now().UnixNano())
+
+	reservedUntil, _, err := ReserveLoginKeys(conn, time.Minute, key)
+	if err != nil || reservedUntil.IsZero() {
+		t.Fatalf("got %v, %v, want the key reserved", reservedUntil, err)
+	}
+	if err = LockLoginKey(conn, key, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err = ReleaseLoginKeys(conn, reservedUntil, key); err != nil {
+		t.Fatal(err)
+	}
+	if lockedUntil, err := GetLockedUntil(conn, key); err != nil || lockedUntil.IsZero() {
+		t.Errorf("got %v, %v, want the key still locked", lockedUntil, err)
+	}
+}
@@ -6,8 +6,12 @@ import (
 )
 
 const (
-	GET_MESSAGES_FOR_TICKET_STMT = "SELECT created_at, type, text FROM messages WHERE ticket=$1"
-	ADD_MESSAGE_TO_TICKET_STMT   = "INSERT INTO messages (type, author, text, ticket) VALUES ($1, $2, $3, $4)"
+	GET_MESSAGES_FOR_TICKET_STMT = `
+	SELECT m.created_at, m.type, m.text FROM messages m JOIN tickets t ON t.id = m.ticket 
+	WHERE m.ticket=$1 AND (t.author_id=$2 OR $3) ORDER BY m.created_at ASC`
+	ADD_MESSAGE_TO_TICKET_STMT = `
+	INSERT INTO messages (type, author_id, text, ticket) 
+	SELECT $1, $2, $3, id FROM tickets WHERE id=$4 AND (author_id=$2 OR $5)`
 )
 
 type Message struct {
@@ -19,8 +23,10 @@ type Message struct {
 	Ticket int       `json:"ticket,omitempty"`
 }
 
-func GetMessagesForTicket(conn *sql.DB, ticketId string) ([]Message, error) {
-	rows, err := conn.Query(GET_MESSAGES_FOR_TICKET_STMT, ticketId)
+// GetMessagesForTicket returns the messages, provided the ticket has been opened by
+// the user or readAny is set.
+func GetMessagesForTicket(conn *sql.DB, ticketId string, userID int, readAny bool) ([]Message, error) {
+	rows, err := conn.Query(GET_MESSAGES_FOR_TICKET_STMT, ticketId, userID, readAny)
 	if err != nil {
 		return nil, err
 	}
@@ -37,8 +43,10 @@ func GetMessagesForTicket(conn *sql.DB, ticketId string) ([]Message, error) {
 	return msgs, nil
 }
 
-func AddMessage(conn *sql.DB, msgType, author, ticketId, text string) bool {
-	exeResults, err := conn.Exec(ADD_MESSAGE_TO_TICKET_STMT, msgType, author, text, ticketId)
+// AddMessage adds the message to the ticket, provided the ticket has been opened by
+// the author or writeAny is set.
+func AddMessage(conn *sql.DB, msgType string, authorID int, ticketId, text string, writeAny bool) bool {
+	exeResults, err := conn.Exec(ADD_MESSAGE_TO_TICKET_STMT, msgType, authorID, text, ticketId, writeAny)
 	if err != nil {
 		return false
 	}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+const (
+	getUserIdByOIDCIdentityStmt = "SELECT id FROM users WHERE oidc_issuer=$1 AND oidc_subject=$2 FOR UPDATE"
+
+	getUserIdByEmailForUpdateStmt = `
+	SELECT id, oidc_subject, email_verified_at IS NOT NULL FROM users WHERE email=$1 FOR UPDATE`
+
+	createOIDCUserStmt = `
+	INSERT INTO users (email, password, username, role, email_verified_at, oidc_issuer, oidc_subject) 
+	VALUES ($1, $2, $3, $4, now(), $5, $6) RETURNING id;`
+
+	// Once linked, the account is the provider's: the password chosen before no longer logs in,
+	// nor do the tokens issued so far.
+	linkOIDCUserStmt = `
+	UPDATE users SET username=$2, role=$3, oidc_issuer=$4, oidc_subject=$5, password=$6, 
+	tokens_valid_after=now() 
+	WHERE id=$1;`
+
+	// The provider is the source of truth for the users logging in with it. The tokens carry the
+	// role, a change of it makes the ones issued so far rejected.
+	updateOIDCUserStmt = `
+	UPDATE users SET username=$2, role=$3, email_verified_at=COALESCE(email_verified_at, now()), 
+	oidc_issuer=$4, oidc_subject=$5, 
+	tokens_valid_after=CASE WHEN role<>$3 THEN now() ELSE tokens_valid_after END 
+	WHERE id=$1;`
+
+	demoteOIDCUserStmt = `
+	UPDATE users SET role=$3, tokens_valid_after=now() 
+	WHERE oidc_issuer=$1 AND oidc_subject=$2 AND role<>$3 RETURNING id;`
+)
+
+var ErrOIDCIdentityConflict = errors.New("account linked to another identity")
+
+// ProvisionOIDCUser returns the user logging in with the identity at the OpenID Connect provider,
+// updated with the username and role the provider tells. The user is looked up by the identity,
+// then by email, and created if not found. An account found by email is linked to the identity,
+// unless its email has never been verified or it is linked to another identity already: then
+// anybody could have registered it. Linking replaces the password with passwordHash and ends
+// the sessions of the account, as does creating one.
+func ProvisionOIDCUser(conn *sql.DB, issuer, subject, email, username, role, passwordHash string) (User, error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(getUserIdByOIDCIdentityStmt, issuer, subject).Scan(&id)
+	switch err {
+	case nil:
+		_, err = tx.Exec(updateOIDCUserStmt, id, username, role, issuer, subject)
+	case sql.ErrNoRows:
+		var linkedSubject sql.NullString
+		var emailVerified bool
+		err = tx.QueryRow(getUserIdByEmailForUpdateStmt, email).Scan(&id, &linkedSubject, &emailVerified)
+		switch err {
+		case nil:
+			if err = canLinkOIDCIdentity(linkedSubject, emailVerified); err != nil {
+				return User{}, err
+			}
+			if _, err = tx.Exec(linkOIDCUserStmt, id, username, role, issuer, subject, passwordHash); err == nil {
+				_, err = tx.Exec(revokeRefreshTokensOfUserStmt, id)
+			}
+		case sql.ErrNoRows:
+			err = tx.QueryRow(createOIDCUserStmt, email, passwordHash, username, role, issuer, subject).Scan(&id)
+		}
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	user, err := scanUser(tx.QueryRow(getUserByIdStmt, id))
+	if err != nil {
+		return user, err
+	}
+	return user, tx.Commit()
+}
+
+// canLinkOIDCIdentity tells whether an account found by the email of an identity can be linked to it.
+func canLinkOIDCIdentity(linkedSubject sql.NullString, emailVerified bool) error {
+	if linkedSubject.Valid || !emailVerified {
+		return ErrOIDCIdentityConflict
+	}
+	return nil
+}
+
+// DemoteOIDCUser takes the staff role away from the user whose identity at the provider no
+// longer grants one and returns their id, 0 if there was nobody to demote.
+func DemoteOIDCUser(conn *sql.DB, issuer, subject string) (id int, err error) {
+	err = conn.QueryRow(demoteOIDCUserStmt, issuer, subject, ROLE_CUSTOMER).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
@@ -0,0 +1,24 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestCanLinkOIDCIdentity(t *testing.T) {
+	cases := []struct {
+		name          string
+		linkedSubject sql.NullString
+		emailVerified bool
+		err           error
+	}{
+		{"verified and unlinked", sql.NullString{}, true, nil},
+		{"never verified", sql.NullString{}, false, ErrOIDCIdentityConflict},
+		{"linked to another identity", sql.NullString{String: "other", Valid: true}, true, ErrOIDCIdentityConflict},
+	}
+	for _, c := range cases {
+		if err := canLinkOIDCIdentity(c.linkedSubject, c.emailVerified); err != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	invalidatePasswordResetTokensStmt = `
+	UPDATE password_reset_tokens SET used_at=now() 
+	WHERE user_id=$1 AND used_at IS NULL;`
+
+	createPasswordResetTokenStmt = `
+	INSERT INTO password_reset_tokens (user_id, token_hash, expires_at) 
+	VALUES ($1, $2, $3);`
+
+	getPasswordResetTokenForUpdateStmt = `
+	SELECT user_id, expires_at, used_at FROM password_reset_tokens 
+	WHERE token_hash=$1 FOR UPDATE;`
+
+	usePasswordResetTokenStmt = "UPDATE password_reset_tokens SET used_at=now() WHERE token_hash=$1"
+
+	// Receiving the reset email proves the address belongs to the user as well. The users of the
+	// single sign-on have no password to reset. The access tokens issued so far are rejected,
+	// in case they have been stolen along with the password.
+	resetPasswordStmt = `
+	UPDATE users SET password=$2, email_verified_at=COALESCE(email_verified_at, now()), tokens_valid_after=now() 
+	WHERE id=$1 AND oidc_subject IS NULL;`
+
+	revokeRefreshTokensOfUserStmt = `
+	UPDATE refresh_tokens SET revoked_at=now() 
+	WHERE user_id=$1 AND revoked_at IS NULL;`
+)
+
+var (
+	ErrResetTokenInvalid    = errors.New("password reset token invalid")
+	ErrPasswordSingleSignOn = errors.New("the user logs in with single sign-on")
+)
+
+// CreatePasswordResetToken stores a new reset token for the user, invalidating
+// the ones requested earlier, so that only the latest email works.
+func CreatePasswordResetToken(conn *sql.DB, userID int, tokenHash string, expiresAt time.Time) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(invalidatePasswordResetTokensStmt, userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(createPasswordResetTokenStmt, userID, tokenHash, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ResetPassword consumes the reset token, sets the new password hash and ends all the sessions
+// of the user, whose id is returned. The users of the single sign-on get ErrPasswordSingleSignOn.
+func ResetPassword(conn *sql.DB, tokenHash, passwordHash string) (userID int, err error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = tx.QueryRow(getPasswordResetTokenForUpdateStmt, tokenHash).Scan(&userID, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return 0, ErrResetTokenInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+	if usedAt.Valid || expiresAt.Before(time.Now()) {
+		return 0, ErrResetTokenInvalid
+	}
+
+	if _, err = tx.Exec(usePasswordResetTokenStmt, tokenHash); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(resetPasswordStmt, userID, passwordHash)
+	if err != nil {
+		return 0, err
+	}
+	reset, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if reset == 0 {
+		return 0, ErrPasswordSingleSignOn
+	}
+	if _, err = tx.Exec(revokeRefreshTokensOfUserStmt, userID); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
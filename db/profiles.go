@@ -0,0 +1,55 @@
+package db
+
+import "database/sql"
+
+const (
+	getPreferencesStmt = "SELECT locale, notify_login_alerts FROM users WHERE id=$1"
+
+	// The parameters left NULL keep the values as they are.
+	updateProfileStmt = `
+	UPDATE users SET username=COALESCE($2, username), locale=COALESCE($3, locale), 
+	notify_login_alerts=COALESCE($4, notify_login_alerts) 
+	WHERE id=$1;`
+)
+
+// NotificationPreferences tell which of the optional emails the user gets.
+type NotificationPreferences struct {
+	LoginAlerts bool `json:"login_alerts"`
+}
+
+// Profile is the user as shown to themselves.
+type Profile struct {
+	UserOverview
+	Locale        string                  `json:"locale"`
+	Notifications NotificationPreferences `json:"notifications"`
+}
+
+// ProfileChanges are the fields the users can change themselves, the nil ones are left as they are.
+type ProfileChanges struct {
+	Username      *string `json:"username"`
+	Locale        *string `json:"locale"`
+	Notifications *struct {
+		LoginAlerts *bool `json:"login_alerts"`
+	} `json:"notifications"`
+}
+
+func GetProfile(conn *sql.DB, id int) (Profile, error) {
+	return getProfile(conn, id)
+}
+
+func getProfile(conn queryer, id int) (profile Profile, err error) {
+	if profile.UserOverview, err = getUserOverview(conn, id); err != nil {
+		return profile, err
+	}
+	err = conn.QueryRow(getPreferencesStmt, id).Scan(&profile.Locale, &profile.Notifications.LoginAlerts)
+	return profile, err
+}
+
+func UpdateProfile(conn *sql.DB, id int, changes ProfileChanges) error {
+	var loginAlerts *bool
+	if changes.Notifications != nil {
+		loginAlerts = changes.Notifications.LoginAlerts
+	}
+	_, err := conn.Exec(updateProfileStmt, id, changes.Username, changes.Locale, loginAlerts)
+	return err
+}
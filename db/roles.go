@@ -0,0 +1,163 @@
+package db
+
+import (
+	"database/sql"
+)
+
+const (
+	ROLE_CUSTOMER   = "customer"
+	ROLE_AGENT      = "agent"
+	ROLE_SUPERVISOR = "supervisor"
+	ROLE_ADMIN      = "admin"
+)
+
+const (
+	PERM_TICKETS_CREATE         = "tickets:create"
+	PERM_TICKETS_READ_OWN       = "tickets:read:own"
+	PERM_TICKETS_READ_ANY       = "tickets:read:any"
+	PERM_TICKETS_STATUS_CANCEL  = "tickets:status:cancel"
+	PERM_TICKETS_STATUS_RESOLVE = "tickets:status:resolve"
+	PERM_MESSAGES_WRITE_OWN     = "messages:write:own"
+	PERM_MESSAGES_WRITE_ANY     = "messages:write:any"
+	PERM_USERS_LIST             = "users:list"
+	PERM_USERS_UNLOCK           = "users:unlock"
+	PERM_USERS_EDIT             = "users:edit"
+	PERM_USERS_DEACTIVATE       = "users:deactivate"
+	PERM_USERS_LOGINS           = "users:logins"
+	PERM_USERS_ROLES            = "users:roles"
+	PERM_USERS_IMPERSONATE      = "users:impersonate"
+	PERM_USERS_EXPORT           = "users:export"
+	PERM_USERS_ERASE            = "users:erase"
+	PERM_API_KEYS_MANAGE        = "api_keys:manage"
+)
+
+var (
+	VALID_ROLES = map[string]bool{
+		ROLE_CUSTOMER:   true,
+		ROLE_AGENT:      true,
+		ROLE_SUPERVISOR: true,
+		ROLE_ADMIN:      true,
+	}
+
+	// Staff open tickets as well, e.g. on behalf of a customer who called in.
+	agentPermissions = []string{
+		PERM_TICKETS_CREATE, PERM_TICKETS_READ_ANY, PERM_TICKETS_STATUS_RESOLVE, PERM_MESSAGES_WRITE_ANY,
+		PERM_USERS_LIST,
+	}
+
+	supervisorPermissions = append([]string{
+		PERM_USERS_UNLOCK, PERM_USERS_EDIT, PERM_USERS_DEACTIVATE, PERM_USERS_LOGINS,
+	}, agentPermissions...)
+
+	// DEFAULT_ROLE_PERMISSIONS is granted once, see seedRoles. Further grants can be made
+	// in the role_permissions table directly.
+	DEFAULT_ROLE_PERMISSIONS = map[string][]string{
+		ROLE_CUSTOMER: {
+			PERM_TICKETS_CREATE, PERM_TICKETS_READ_OWN, PERM_TICKETS_STATUS_CANCEL, PERM_MESSAGES_WRITE_OWN,
+		},
+		ROLE_AGENT:      agentPermissions,
+		ROLE_SUPERVISOR: supervisorPermissions,
+		ROLE_ADMIN: append([]string{
+			PERM_USERS_ROLES, PERM_USERS_IMPERSONATE, PERM_USERS_EXPORT, PERM_USERS_ERASE, PERM_API_KEYS_MANAGE,
+		}, supervisorPermissions...),
+	}
+)
+
+const (
+	createTableRolesStmt = `
+	CREATE TABLE IF NOT EXISTS roles
+	(
+		name VARCHAR(32),
+		CONSTRAINT pk_roles PRIMARY KEY (name)
+	);
+	CREATE TABLE IF NOT EXISTS permissions
+	(
+		name VARCHAR(64),
+		CONSTRAINT pk_permissions PRIMARY KEY (name)
+	);
+	CREATE TABLE IF NOT EXISTS role_permissions
+	(
+		role VARCHAR(32) REFERENCES roles (name) ON DELETE CASCADE,
+		permission VARCHAR(64) REFERENCES permissions (name) ON DELETE CASCADE,
+		CONSTRAINT pk_role_permissions PRIMARY KEY (role, permission)
+	);
+	CREATE TABLE IF NOT EXISTS seeded_role_permissions
+	(
+		role VARCHAR(32),
+		permission VARCHAR(64),
+		CONSTRAINT pk_seeded_role_permissions PRIMARY KEY (role, permission)
+	);`
+
+	createRoleStmt           = "INSERT INTO roles (name) VALUES ($1) ON CONFLICT DO NOTHING"
+	createPermissionStmt     = "INSERT INTO permissions (name) VALUES ($1) ON CONFLICT DO NOTHING"
+	getPermissionsOfRoleStmt = "SELECT permission FROM role_permissions WHERE role=$1 ORDER BY permission"
+
+	// A default grant is only made the first time it is seeded, so revoking it sticks.
+	seedGrantStmt = `
+	WITH seeded AS (
+		INSERT INTO seeded_role_permissions (role, permission) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING RETURNING role, permission
+	)
+	INSERT INTO role_permissions (role, permission) SELECT role, permission FROM seeded
+	ON CONFLICT DO NOTHING;`
+
+	// Staff members become agents and superusers admins.
+	migrateUsersToRolesStmt = `
+	DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name='users' AND column_name='is_staff') THEN
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(32) NOT NULL DEFAULT 'customer' REFERENCES roles (name);
+			UPDATE users SET role = CASE WHEN is_superuser THEN 'admin' WHEN is_staff THEN 'agent' ELSE 'customer' END;
+			ALTER TABLE users DROP COLUMN is_staff, DROP COLUMN is_superuser;
+		END IF;
+	END $$;`
+)
+
+// seedRoles creates the roles and permissions of DEFAULT_ROLE_PERMISSIONS and grants each of the
+// defaults once, when first seeded, whether the role is new or the permission has been added to
+// the defaults since. The grants revoked in role_permissions afterwards stay revoked.
+func seedRoles(conn *sql.DB) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for role, permissions := range DEFAULT_ROLE_PERMISSIONS {
+		if _, err = tx.Exec(createRoleStmt, role); err != nil {
+			return err
+		}
+		for _, permission := range permissions {
+			if _, err = tx.Exec(createPermissionStmt, permission); err != nil {
+				return err
+			}
+			if _, err = tx.Exec(seedGrantStmt, role, permission); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func GetPermissionsOfRole(conn *sql.DB, role string) ([]string, error) {
+	rows, err := conn.Query(getPermissionsOfRoleStmt, role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
+
+// IsStaffRole tells the support team from the customers.
+func IsStaffRole(role string) bool {
+	return role != ROLE_CUSTOMER
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	createRefreshTokenStmt = `
+	INSERT INTO refresh_tokens (user_id, session_id, token_hash, csrf_hash, expires_at)
+	VALUES ($1, $2, $3, $4, $5);`
+
+	getRefreshTokenForUpdateStmt = `
+	SELECT user_id, session_id, csrf_hash, expires_at, revoked_at FROM refresh_tokens
+	WHERE token_hash=$1 FOR UPDATE;`
+
+	revokeRefreshTokenStmt = "UPDATE refresh_tokens SET revoked_at=now() WHERE token_hash=$1"
+
+	revokeRefreshTokensOfSessionStmt = `
+	UPDATE refresh_tokens SET revoked_at=now() 
+	WHERE session_id=$1 AND revoked_at IS NULL;`
+
+	revokeTokenIdsStmt = `
+	INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $3), ($2, $3)
+	ON CONFLICT (jti) DO NOTHING;`
+
+	revokeTokenIdStmt = `
+	INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2)
+	ON CONFLICT (jti) DO NOTHING;`
+
+	// The access tokens of a session are revoked by its id, see isTokenRevokedStmt.
+	revokeOtherSessionsStmt = `
+	INSERT INTO revoked_tokens (jti, expires_at)
+	SELECT DISTINCT session_id, $3::timestamp FROM refresh_tokens 
+	WHERE user_id=$1 AND session_id<>$2 AND expires_at > now()
+	ON CONFLICT (jti) DO NOTHING;`
+
+	revokeRefreshTokensOfOtherSessionsStmt = `
+	UPDATE refresh_tokens SET revoked_at=now() 
+	WHERE user_id=$1 AND session_id<>$2 AND revoked_at IS NULL;`
+
+	purgeRevokedTokensStmt = "DELETE FROM revoked_tokens WHERE expires_at < now()"
+
+	isTokenRevokedStmt = "SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti IN ($1, $2))"
+)
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenExpired  = errors.New("refresh token expired")
+	ErrRefreshTokenReused   = errors.New("refresh token already used")
+	ErrRefreshTokenCSRF     = errors.New("csrf token of the refresh token missing or invalid")
+	ErrRefreshTokenNoCSRF   = errors.New("refresh token issued without a csrf token")
+)
+
+// CreateRefreshToken stores the refresh token along with the hash of the csrf token issued with it.
+func CreateRefreshToken(conn *sql.DB, userID int, sessionID, tokenHash, csrfHash string, expiresAt time.Time) error {
+	_, err := conn.Exec(createRefreshTokenStmt, userID, sessionID, tokenHash, csrfHash, expiresAt)
+	return err
+}
+
+// RotateRefreshToken swaps a valid refresh token for a new one within the same session.
+// Presenting an already rotated token revokes the whole session, since that
+// means the token has leaked and is being replayed by someone. Unless checkCSRF is false,
+// csrfHash has to be the hash of the csrf token issued along with the old token, and
+// newCSRFHash is stored along with the new one. A token issued before the csrf tokens were
+// stored with them has nothing to check against: it is revoked with ErrRefreshTokenNoCSRF.
+func RotateRefreshToken(conn *sql.DB, oldHash, newHash string, checkCSRF bool, csrfHash, newCSRFHash string,
+	expiresAt time.Time) (userID int, sessionID string, err error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var oldCSRFHash sql.NullString
+	var oldExpiresAt time.Time
+	var revokedAt sql.NullTime
+	err = tx.QueryRow(getRefreshTokenForUpdateStmt, oldHash).Scan(&userID, &sessionID, &oldCSRFHash, &oldExpiresAt,
+		&revokedAt)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	// Checked first, so that a forged request can neither rotate the token nor end the session.
+	if checkCSRF && !oldCSRFHash.Valid {
+		if _, err = tx.Exec(revokeRefreshTokenStmt, oldHash); err != nil {
+			return 0, "", err
+		}
+		if err = tx.Commit(); err != nil {
+			return 0, "", err
+		}
+		return 0, "", ErrRefreshTokenNoCSRF
+	}
+	if checkCSRF && (csrfHash == "" || subtle.ConstantTimeCompare([]byte(csrfHash), []byte(oldCSRFHash.String)) != 1) {
+		return 0, "", ErrRefreshTokenCSRF
+	}
+
+	if revokedAt.Valid {
+		if _, err = tx.Exec(revokeRefreshTokensOfSessionStmt, sessionID); err != nil {
+			return 0, "", err
+		}
+		if err = tx.Commit(); err != nil {
+			return 0, "", err
+		}
+		return 0, "", ErrRefreshTokenReused
+	}
+
+	if oldExpiresAt.Before(time.Now()) {
+		return 0, "", ErrRefreshTokenExpired
+	}
+
+	if _, err = tx.Exec(revokeRefreshTokenStmt, oldHash); err != nil {
+		return 0, "", err
+	}
+	if _, err = tx.Exec(createRefreshTokenStmt, userID, sessionID, newHash, newCSRFHash, expiresAt); err != nil {
+		return 0, "", err
+	}
+	return userID, sessionID, tx.Commit()
+}
+
+// RevokeSession revokes the access token with the given jti, every other access token
+// issued within the session (until they would have expired anyway) and the session's
+// refresh tokens.
+func RevokeSession(conn *sql.DB, sessionID, jti string, until time.Time) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(purgeRevokedTokensStmt); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(revokeTokenIdsStmt, sessionID, jti, until); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(revokeRefreshTokensOfSessionStmt, sessionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RevokeTokenID revokes a single token, e.g. a one-time token that has been used.
+func RevokeTokenID(conn *sql.DB, jti string, until time.Time) error {
+	_, err := conn.Exec(revokeTokenIdStmt, jti, until)
+	return err
+}
+
+func IsTokenRevoked(conn *sql.DB, jti, sessionID string) (revoked bool, err error) {
+	err = conn.QueryRow(isTokenRevokedStmt, jti, sessionID).Scan(&revoked)
+	return revoked, err
+}
@@ -6,43 +6,56 @@ import (
 )
 
 const (
-	DEFAULT_TICKET_STATUS         = "pending"
-	DEFAULT_MSG_TYPE              = "request"
-	GET_ALL_TICKETS_STMT          = "SELECT id, created_at, updated_at, author, topic, status FROM tickets ORDER BY created_at ASC"
-	GET_TICKETS_OF_THIS_USER_STMT = "SELECT id, created_at, updated_at, topic, status FROM tickets WHERE author=$1 ORDER BY created_at ASC"
+	DEFAULT_TICKET_STATUS = "pending"
+	DEFAULT_MSG_TYPE      = "request"
+	GET_ALL_TICKETS_STMT  = `
+	SELECT t.id, t.created_at, t.updated_at, t.author_id, u.email, t.topic, t.status 
+	FROM tickets t LEFT JOIN users u ON u.id = t.author_id ORDER BY t.created_at ASC`
+	GET_TICKETS_OF_THIS_USER_STMT = "SELECT id, created_at, updated_at, topic, status FROM tickets WHERE author_id=$1 ORDER BY created_at ASC"
 	CREATE_TICKET_STMT            = `
 	WITH insert_to_tickets AS 
-	(INSERT INTO tickets (author, topic, status) 
+	(INSERT INTO tickets (author_id, topic, status) 
 	VALUES ($1, $2, $3) RETURNING id)
-    INSERT INTO messages (author, ticket, text, type) 
+    INSERT INTO messages (author_id, ticket, text, type) 
 	VALUES ($1, (SELECT id FROM insert_to_tickets), $4, $5) RETURNING id;
 `
-	GET_TICKET_STMT              = "SELECT created_at, updated_at, author, topic, status FROM tickets WHERE id=$1"
-	GET_TICKET_OF_THIS_USER_STMT = "SELECT created_at, updated_at, topic, status FROM tickets WHERE id=$1 and author=$2"
-	UPDATE_TICKET_STMT           = "UPDATE tickets SET status=$2 WHERE id=$1"
+	GET_TICKET_STMT = `
+	SELECT t.created_at, t.updated_at, t.author_id, u.email, t.topic, t.status 
+	FROM tickets t LEFT JOIN users u ON u.id = t.author_id WHERE t.id=$1`
+	GET_TICKET_OF_THIS_USER_STMT = "SELECT created_at, updated_at, topic, status FROM tickets WHERE id=$1 and author_id=$2"
+	UPDATE_TICKET_STMT           = "UPDATE tickets SET status=$2 WHERE id=$1 AND (author_id=$3 OR $4)"
+
+	getTicketsPageOfUserStmt = `
+	SELECT id, created_at, updated_at, topic, status FROM tickets WHERE author_id=$1 
+	ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3;`
+
+	countTicketsByStatusOfUserStmt = "SELECT status, count(*) FROM tickets WHERE author_id=$1 GROUP BY status"
 )
 
 type Ticket struct {
-	ID     int       `json:"id,omitempty"`
-	CrtdAt time.Time `json:"created_at"`
-	UpdAt  time.Time `json:"updated_at"`
-	Author string    `json:"author,omitempty"`
-	Topic  string    `json:"topic"`
-	Status string    `json:"status"`
+	ID       int       `json:"id,omitempty"`
+	CrtdAt   time.Time `json:"created_at"`
+	UpdAt    time.Time `json:"updated_at"`
+	AuthorID int       `json:"author_id,omitempty"`
+	Author   string    `json:"author,omitempty"`
+	Topic    string    `json:"topic"`
+	Status   string    `json:"status"`
 }
 
-func CreateTicket(conn *sql.DB, email, topic, text string) (lastInsertId int, err error) {
-	err = conn.QueryRow(CREATE_TICKET_STMT, email, topic, DEFAULT_TICKET_STATUS, text, DEFAULT_MSG_TYPE).Scan(&lastInsertId)
+func CreateTicket(conn *sql.DB, authorID int, topic, text string) (lastInsertId int, err error) {
+	err = conn.QueryRow(CREATE_TICKET_STMT, authorID, topic, DEFAULT_TICKET_STATUS, text, DEFAULT_MSG_TYPE).Scan(&lastInsertId)
 	return lastInsertId, err
 }
 
-func GetTicketsForUser(conn *sql.DB, email string, isStaff, isSuperuser bool) (tickets []Ticket, err error) {
+// GetTicketsForUser lists all the tickets, along with their authors, if readAny is set,
+// and only the user's own tickets otherwise.
+func GetTicketsForUser(conn *sql.DB, userID int, readAny bool) (tickets []Ticket, err error) {
 	var rows *sql.Rows
 	switch {
-	case isStaff || isSuperuser:
+	case readAny:
 		rows, err = conn.Query(GET_ALL_TICKETS_STMT)
 	default:
-		rows, err = conn.Query(GET_TICKETS_OF_THIS_USER_STMT, email)
+		rows, err = conn.Query(GET_TICKETS_OF_THIS_USER_STMT, userID)
 	}
 
 	if err != nil {
@@ -52,8 +65,11 @@ func GetTicketsForUser(conn *sql.DB, email string, isStaff, isSuperuser bool) (t
 	for rows.Next() {
 		var ticket Ticket
 		switch {
-		case isStaff || isSuperuser:
-			err = rows.Scan(&ticket.ID, &ticket.CrtdAt, &ticket.UpdAt, &ticket.Author, &ticket.Topic, &ticket.Status)
+		case readAny:
+			var authorID sql.NullInt64
+			var author sql.NullString
+			err = rows.Scan(&ticket.ID, &ticket.CrtdAt, &ticket.UpdAt, &authorID, &author, &ticket.Topic, &ticket.Status)
+			ticket.AuthorID, ticket.Author = int(authorID.Int64), author.String
 		default:
 			err = rows.Scan(&ticket.ID, &ticket.CrtdAt, &ticket.UpdAt, &ticket.Topic, &ticket.Status)
 		}
@@ -67,18 +83,71 @@ func GetTicketsForUser(conn *sql.DB, email string, isStaff, isSuperuser bool) (t
 	return tickets, nil
 }
 
-func GetOneTicketForUser(conn *sql.DB, id, email string, isStaff, isSuperuser bool) (ticket Ticket, err error) {
+// GetTicketsPageOfUser returns the page of the user's tickets, the latest first.
+func GetTicketsPageOfUser(conn *sql.DB, userID, limit, offset int) ([]Ticket, error) {
+	rows, err := conn.Query(getTicketsPageOfUserStmt, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tickets := []Ticket{}
+	for rows.Next() {
+		var ticket Ticket
+		if err := rows.Scan(&ticket.ID, &ticket.CrtdAt, &ticket.UpdAt, &ticket.Topic, &ticket.Status); err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, ticket)
+	}
+	return tickets, rows.Err()
+}
+
+// CountTicketsByStatusOfUser returns the number of the user's tickets in each of the statuses,
+// zero included.
+func CountTicketsByStatusOfUser(conn *sql.DB, userID int) (map[string]int, error) {
+	return countTicketsByStatusOfUser(conn, userID)
+}
+
+func countTicketsByStatusOfUser(conn queryer, userID int) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, status := range VALID_STATUSES {
+		counts[status] = 0
+	}
+
+	rows, err := conn.Query(countTicketsByStatusOfUserStmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
+func GetOneTicketForUser(conn *sql.DB, id string, userID int, readAny bool) (ticket Ticket, err error) {
 	switch {
-	case isStaff || isSuperuser:
-		err = conn.QueryRow(GET_TICKET_STMT, id).Scan(&ticket.CrtdAt, &ticket.UpdAt, &ticket.Author, &ticket.Topic, &ticket.Status)
+	case readAny:
+		var authorID sql.NullInt64
+		var author sql.NullString
+		err = conn.QueryRow(GET_TICKET_STMT, id).Scan(&ticket.CrtdAt, &ticket.UpdAt, &authorID, &author, &ticket.Topic, &ticket.Status)
+		ticket.AuthorID, ticket.Author = int(authorID.Int64), author.String
 	default:
-		err = conn.QueryRow(GET_TICKET_OF_THIS_USER_STMT, id, email).Scan(&ticket.CrtdAt, &ticket.UpdAt, &ticket.Topic, &ticket.Status)
+		err = conn.QueryRow(GET_TICKET_OF_THIS_USER_STMT, id, userID).Scan(&ticket.CrtdAt, &ticket.UpdAt, &ticket.Topic, &ticket.Status)
 	}
 	return ticket, err
 }
 
-func UpdateTicket(conn *sql.DB, id, status string) bool {
-	exeResults, err := conn.Exec(UPDATE_TICKET_STMT, id, status)
+// UpdateTicket changes the status of the ticket, provided it has been opened by
+// the user or updateAny is set.
+func UpdateTicket(conn *sql.DB, id, status string, userID int, updateAny bool) bool {
+	exeResults, err := conn.Exec(UPDATE_TICKET_STMT, id, status, userID, updateAny)
 	if err != nil {
 		return false
 	}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+const (
+	setPendingTotpSecretStmt = `
+	UPDATE users SET totp_secret=$2, totp_last_step=NULL 
+	WHERE id=$1 AND totp_enabled_at IS NULL;`
+
+	getTotpStmt = "SELECT totp_secret, totp_enabled_at IS NOT NULL FROM users WHERE id=$1"
+
+	enableTotpStmt = `
+	UPDATE users SET totp_enabled_at=now(), totp_last_step=$2 
+	WHERE id=$1 AND totp_secret IS NOT NULL AND totp_enabled_at IS NULL;`
+
+	// Only a step later than the last accepted one can be used, so a code cannot be replayed.
+	useTotpStepStmt = `
+	UPDATE users SET totp_last_step=$2 
+	WHERE id=$1 AND (totp_last_step IS NULL OR totp_last_step < $2);`
+
+	disableTotpStmt = "UPDATE users SET totp_secret=NULL, totp_enabled_at=NULL, totp_last_step=NULL WHERE id=$1"
+
+	deleteRecoveryCodesStmt = "DELETE FROM recovery_codes WHERE user_id=$1"
+
+	createRecoveryCodeStmt = "INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)"
+
+	useRecoveryCodeStmt = `
+	UPDATE recovery_codes SET used_at=now() 
+	WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL;`
+)
+
+var ErrTotpAlreadyEnabled = errors.New("totp already enabled")
+
+// SetPendingTotpSecret stores a secret that only becomes effective once confirmed
+// with EnableTotp. Enrolling again before confirming replaces the secret.
+func SetPendingTotpSecret(conn *sql.DB, userID int, secret string) error {
+	exeResults, err := conn.Exec(setPendingTotpSecretStmt, userID, secret)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := exeResults.RowsAffected(); rowsAffected == 0 {
+		return ErrTotpAlreadyEnabled
+	}
+	return nil
+}
+
+func GetTotp(conn *sql.DB, userID int) (secret string, enabled bool, err error) {
+	var nullableSecret sql.NullString
+	err = conn.QueryRow(getTotpStmt, userID).Scan(&nullableSecret, &enabled)
+	return nullableSecret.String, enabled, err
+}
+
+// EnableTotp confirms the pending secret and replaces the recovery codes of the user.
+func EnableTotp(conn *sql.DB, userID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	exeResults, err := tx.Exec(enableTotpStmt, userID, step)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := exeResults.RowsAffected(); rowsAffected == 0 {
+		return ErrTotpAlreadyEnabled
+	}
+
+	if _, err = tx.Exec(deleteRecoveryCodesStmt, userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err = tx.Exec(createRecoveryCodeStmt, userID, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func UseTotpStep(conn *sql.DB, userID int, step int64) bool {
+	exeResults, err := conn.Exec(useTotpStepStmt, userID, step)
+	if err != nil {
+		return false
+	}
+
+	if rowsAffected, _ := exeResults.RowsAffected(); rowsAffected == 0 {
+		return false
+	}
+
+	return true
+}
+
+func UseRecoveryCode(conn *sql.DB, userID int, codeHash string) bool {
+	exeResults, err := conn.Exec(useRecoveryCodeStmt, userID, codeHash)
+	if err != nil {
+		return false
+	}
+
+	if rowsAffected, _ := exeResults.RowsAffected(); rowsAffected == 0 {
+		return false
+	}
+
+	return true
+}
+
+func DisableTotp(conn *sql.DB, userID int) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(disableTotpStmt, userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(deleteRecoveryCodesStmt, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -2,63 +2,397 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
+	"math"
+	"strings"
 	"time"
 )
 
 const (
+	userColumns = `id, username, email, role, email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL, 
+	deactivated_at IS NULL, oidc_subject IS NOT NULL`
+
 	createUserStmt = `
-	INSERT INTO users (email, password, username, is_staff, is_superuser) 
-	VALUES ($1, crypt($2, gen_salt('bf', 8)), $3, $4, $5);`
-
-	getUserDetailsStmt = `
-	SELECT id, username, email, is_staff, is_superuser FROM  users 
-	WHERE email=$1 and password=crypt($2, password);`
-
-	GET_ALL_USERS = `
-	SELECT u.id, u.created_at, u.username, u.email, u.is_staff, count(t.id) as ticketsCount
-	FROM users u LEFT JOIN tickets t ON u.email = t.author
-	GROUP BY u.id
-	ORDER BY ticketsCount DESC
-	`
+	INSERT INTO users (email, password, username, role) 
+	VALUES ($1, $2, $3, $4) RETURNING id;`
+
+	getUserWithPasswordHashStmt = "SELECT " + userColumns + ", password FROM users WHERE email=$1"
+
+	getUserByIdStmt = "SELECT " + userColumns + " FROM users WHERE id=$1"
+
+	getUserByEmailStmt = "SELECT " + userColumns + " FROM users WHERE email=$1"
+
+	// Keeps the access tokens of the session the password is changed in, the others are revoked one by one.
+	setPasswordStmt = "UPDATE users SET password=$2 WHERE id=$1"
+
+	setPasswordRevokingTokensStmt = "UPDATE users SET password=$2, tokens_valid_after=now() WHERE id=$1 AND oidc_subject IS NULL"
+
+	// Only replaces the hash it has been computed from, so a concurrent password change wins.
+	rehashPasswordStmt = "UPDATE users SET password=$3 WHERE id=$1 AND password=$2"
+
+	lockUserStmt = "SELECT " + userColumns + " FROM users WHERE id=$1 FOR UPDATE"
+
+	setUsernameStmt = "UPDATE users SET username=$2 WHERE id=$1"
+
+	// The tokens carry the role, the ones issued so far have to be replaced.
+	setUserRoleRevokingTokensStmt = "UPDATE users SET role=$2, tokens_valid_after=now() WHERE id=$1"
+
+	markEmailVerifiedStmt = "UPDATE users SET email_verified_at=now() WHERE id=$1 AND email_verified_at IS NULL"
+
+	deactivateUserStmt = `
+	UPDATE users SET deactivated_at=COALESCE(deactivated_at, now()), tokens_valid_after=now() 
+	WHERE id=$1;`
+
+	// The erased users stay deactivated for good.
+	reactivateUserStmt = "UPDATE users SET deactivated_at=NULL WHERE id=$1 AND erased_at IS NULL"
+
+	getUserAccessStmt = "SELECT deactivated_at IS NULL, tokens_valid_after FROM users WHERE id=$1"
+
+	// The last activity is the latest message written or successful login.
+	getUserOverviewStmt = `
+	SELECT u.id, u.created_at, u.username, u.email, u.role, u.email_verified_at IS NOT NULL, 
+	u.deactivated_at IS NULL, 
+	GREATEST(
+		(SELECT max(m.created_at) FROM messages m WHERE m.author_id=u.id),
+		(SELECT max(e.created_at) FROM login_events e WHERE e.user_id=u.id AND e.outcome='` + LOGIN_SUCCESS + `')
+	)
+	FROM users u WHERE u.id=$1;`
+
+	// The filters and the order are appended by GetUsersPage.
+	GET_USERS_PAGE = `
+	SELECT u.id, u.created_at, u.username, u.email, u.role, u.email_verified_at IS NOT NULL, 
+	u.deactivated_at IS NULL, count(t.id) as ticketsCount
+	FROM users u LEFT JOIN tickets t ON u.id = t.author_id`
+
+	countUsersStmt = "SELECT count(*) FROM users u"
 )
 
 type User struct {
-	ID           int       `json:"id"`
-	CrtdAt       time.Time `json:"created_at"`
-	Username     string    `json:"username"`
-	Email        string    `json:"email"`
-	IsStaff      bool      `json:"is_staff"`
-	IsSuperuser  bool      `json:"is_superuser,omitempty"`
-	TicketsCount int       `json:"tickets_count"`
-}
-
-func CreateUser(conn *sql.DB, email, password, username string,
-	is_staff, is_superuser bool) error {
-	_, err := conn.Exec(createUserStmt, email, password, username, is_staff, is_superuser)
-	return err
+	ID            int       `json:"id"`
+	CrtdAt        time.Time `json:"created_at"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email"`
+	Role          string    `json:"role"`
+	EmailVerified bool      `json:"email_verified"`
+	TotpEnabled   bool      `json:"-"`
+	Active        bool      `json:"active"`
+	TicketsCount  int       `json:"tickets_count"`
+	// SingleSignOn users log in with the identity provider, never with a password.
+	SingleSignOn bool `json:"-"`
+}
+
+// UserOverview is the user as shown to the staff, along with their tickets.
+type UserOverview struct {
+	User
+	LastActivityAt  *time.Time     `json:"last_activity_at"`
+	TicketsByStatus map[string]int `json:"tickets_by_status"`
+}
+
+// USER_SORT_KEYS are what the list of users can be ordered by, the ties are broken by id.
+var USER_SORT_KEYS = map[string]string{
+	"tickets_count": "ticketsCount",
+	"created_at":    "u.created_at",
+	"username":      "lower(u.username)",
+	"email":         "u.email",
+	"id":            "u.id",
+}
+
+// UserFilter narrows down the list of users, the zero values match everybody. Search is a
+// substring of the email or the username, whatever the case.
+type UserFilter struct {
+	Staff       *bool
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	Search      string
 }
 
-func GetUserDetails(conn *sql.DB, email, password string) (user User, err error) {
-	err = conn.QueryRow(getUserDetailsStmt, email, password).Scan(
-		&user.ID, &user.Username, &user.Email, &user.IsStaff, &user.IsSuperuser)
+// where returns the conditions of the filter on the users u, along with their arguments.
+func (f UserFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.Staff != nil {
+		if *f.Staff {
+			add("u.role<>$%d", ROLE_CUSTOMER)
+		} else {
+			add("u.role=$%d", ROLE_CUSTOMER)
+		}
+	}
+	if f.CreatedFrom != nil {
+		add("u.created_at>=$%d", *f.CreatedFrom)
+	}
+	if f.CreatedTo != nil {
+		add("u.created_at<=$%d", *f.CreatedTo)
+	}
+	if f.Search != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(f.Search) + "%"
+		add("(u.email ILIKE $%[1]d OR u.username ILIKE $%[1]d)", pattern)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// UserChanges are the fields of the user to update, the nil ones are left as they are.
+type UserChanges struct {
+	Username *string `json:"username"`
+	Role     *string `json:"role"`
+	Active   *bool   `json:"active"`
+}
+
+func scanUser(row *sql.Row) (user User, err error) {
+	err = row.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified, &user.TotpEnabled, &user.Active,
+		&user.SingleSignOn)
 	return user, err
 }
 
-func GetAllUsers(conn *sql.DB) ([]User, error) {
-	rows, err := conn.Query(GET_ALL_USERS)
+func CreateUser(conn *sql.DB, email, passwordHash, username, role string) (id int, err error) {
+	err = conn.QueryRow(createUserStmt, email, passwordHash, username, role).Scan(&id)
+	return id, err
+}
+
+// GetUserWithPasswordHash returns the user along with the hash to check the password against.
+func GetUserWithPasswordHash(conn *sql.DB, email string) (user User, passwordHash string, err error) {
+	err = conn.QueryRow(getUserWithPasswordHashStmt, email).Scan(&user.ID, &user.Username, &user.Email,
+		&user.Role, &user.EmailVerified, &user.TotpEnabled, &user.Active, &user.SingleSignOn, &passwordHash)
+	return user, passwordHash, err
+}
+
+// RehashPassword replaces the old hash of the user's password with one made with the current
+// algorithm and cost.
+func RehashPassword(conn *sql.DB, id int, oldHash, newHash string) error {
+	_, err := conn.Exec(rehashPasswordStmt, id, oldHash, newHash)
+	return err
+}
+
+func GetUserByID(conn *sql.DB, id int) (User, error) {
+	return scanUser(conn.QueryRow(getUserByIdStmt, id))
+}
+
+func GetUserByEmail(conn *sql.DB, email string) (User, error) {
+	return scanUser(conn.QueryRow(getUserByEmailStmt, email))
+}
+
+// GetUserOverview returns the user along with the number of their tickets in every status.
+func GetUserOverview(conn *sql.DB, id int) (UserOverview, error) {
+	return getUserOverview(conn, id)
+}
+
+func getUserOverview(conn queryer, id int) (overview UserOverview, err error) {
+	var lastActivityAt sql.NullTime
+	u := &overview.User
+	err = conn.QueryRow(getUserOverviewStmt, id).Scan(&u.ID, &u.CrtdAt, &u.Username, &u.Email, &u.Role,
+		&u.EmailVerified, &u.Active, &lastActivityAt)
+	if err != nil {
+		return overview, err
+	}
+	overview.LastActivityAt = nullableTime(lastActivityAt)
+
+	overview.TicketsByStatus, err = countTicketsByStatusOfUser(conn, u.ID)
+	for _, count := range overview.TicketsByStatus {
+		u.TicketsCount += count
+	}
+	return overview, err
+}
+
+// GetUsersPage returns the users matching the filter, ordered by one of USER_SORT_KEYS.
+func GetUsersPage(conn *sql.DB, filter UserFilter, sortKey string, desc bool, limit, offset int) ([]User, error) {
+	direction := "ASC"
+	if desc {
+		direction = "DESC"
+	}
+	where, args := filter.where()
+	query := fmt.Sprintf("%s%s GROUP BY u.id ORDER BY %s %s, u.id %s LIMIT $%d OFFSET $%d", GET_USERS_PAGE, where,
+		USER_SORT_KEYS[sortKey], direction, direction, len(args)+1, len(args)+2)
+
+	rows, err := conn.Query(query, append(args, limit, offset)...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	var users []User
+	users := []User{}
 	for rows.Next() {
 		var u User
-		err := rows.Scan(&u.ID, &u.CrtdAt, &u.Username, &u.Email, &u.IsStaff, &u.TicketsCount)
+		err := rows.Scan(&u.ID, &u.CrtdAt, &u.Username, &u.Email, &u.Role, &u.EmailVerified, &u.Active, &u.TicketsCount)
 		if err != nil {
 			return nil, err
 		}
 		users = append(users, u)
 	}
+	return users, rows.Err()
+}
+
+// GetAllUsers returns every user, the ones with the most tickets first.
+func GetAllUsers(conn *sql.DB) ([]User, error) {
+	return GetUsersPage(conn, UserFilter{}, "tickets_count", true, math.MaxInt32, 0)
+}
+
+func CountUsers(conn *sql.DB, filter UserFilter) (count int, err error) {
+	where, args := filter.where()
+	err = conn.QueryRow(countUsersStmt+where, args...).Scan(&count)
+	return count, err
+}
+
+// SetUserRole grants the role to the user, the tokens issued with the former one are rejected.
+func SetUserRole(conn *sql.DB, id int, role string) error {
+	_, err := conn.Exec(setUserRoleRevokingTokensStmt, id, role)
+	return err
+}
+
+// SetPassword replaces the password hash of the user and ends all their sessions: the refresh
+// tokens are revoked and the access tokens issued so far rejected. The users of the single
+// sign-on get ErrPasswordSingleSignOn.
+func SetPassword(conn *sql.DB, id int, passwordHash string) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(setPasswordRevokingTokensStmt, id, passwordHash)
+	if err != nil {
+		return err
+	}
+	set, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if set == 0 {
+		return ErrPasswordSingleSignOn
+	}
+	if _, err = tx.Exec(revokeRefreshTokensOfUserStmt, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ChangePassword replaces the password hash of the user and ends all their sessions but the
+// current one. The access tokens of the other sessions are revoked until they would have
+// expired anyway.
+func ChangePassword(conn *sql.DB, id int, passwordHash, currentSessionID string, until time.Time) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(setPasswordStmt, id, passwordHash); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(purgeRevokedTokensStmt); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(revokeOtherSessionsStmt, id, currentSessionID, until); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(revokeRefreshTokensOfOtherSessionsStmt, id, currentSessionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateUser applies the changes to the user and returns the user as they were before. A change
+// of the role or a deactivation makes the tokens issued to the user so far rejected.
+func UpdateUser(conn *sql.DB, id int, changes UserChanges) (before User, err error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return before, err
+	}
+	defer tx.Rollback()
 
-	return users, nil
+	if before, err = scanUser(tx.QueryRow(lockUserStmt, id)); err != nil {
+		return before, err
+	}
+
+	if changes.Username != nil && *changes.Username != before.Username {
+		if _, err = tx.Exec(setUsernameStmt, id, *changes.Username); err != nil {
+			return before, err
+		}
+	}
+	if changes.Role != nil && *changes.Role != before.Role {
+		if _, err = tx.Exec(setUserRoleRevokingTokensStmt, id, *changes.Role); err != nil {
+			return before, err
+		}
+	}
+	if changes.Active != nil && *changes.Active != before.Active {
+		if *changes.Active {
+			err = reactivateUser(tx, id)
+		} else if _, err = tx.Exec(deactivateUserStmt, id); err == nil {
+			_, err = tx.Exec(revokeRefreshTokensOfUserStmt, id)
+		}
+		if err != nil {
+			return before, err
+		}
+	}
+	return before, tx.Commit()
+}
+
+func MarkEmailVerified(conn *sql.DB, id int) error {
+	_, err := conn.Exec(markEmailVerifiedStmt, id)
+	return err
+}
+
+// DeactivateUser locks the user out: logins are refused, the refresh tokens revoked and the
+// access tokens issued so far are rejected.
+func DeactivateUser(conn *sql.DB, id int) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(deactivateUserStmt, id); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(revokeRefreshTokensOfUserStmt, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReactivateUser lets the user log in again, unless they have been erased (ErrUserErased).
+func ReactivateUser(conn *sql.DB, id int) error {
+	return reactivateUser(conn, id)
+}
+
+// execer is either the connection or a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryer is either the connection or a transaction.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func reactivateUser(conn execer, id int) error {
+	result, err := conn.Exec(reactivateUserStmt, id)
+	if err != nil {
+		return err
+	}
+	reactivated, err := result.RowsAffected()
+	if err == nil && reactivated == 0 {
+		err = ErrUserErased
+	}
+	return err
+}
+
+// GetUserAccess tells whether the user is active and the time the tokens of the user are
+// only accepted if issued after (the zero time if all are). A user that does not exist
+// is inactive.
+func GetUserAccess(conn *sql.DB, id int) (active bool, tokensValidAfter time.Time, err error) {
+	var validAfter sql.NullTime
+	err = conn.QueryRow(getUserAccessStmt, id).Scan(&active, &validAfter)
+	if err == sql.ErrNoRows {
+		return false, tokensValidAfter, nil
+	}
+	return active, validAfter.Time, err
 }
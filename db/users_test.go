@@ -0,0 +1,39 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUserFilterWhere(t *testing.T) {
+	staff, customers := true, false
+	from := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 7, 31, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name   string
+		filter UserFilter
+		where  string
+		args   []interface{}
+	}{
+		{"nothing", UserFilter{}, "", nil},
+		{"staff", UserFilter{Staff: &staff}, " WHERE u.role<>$1", []interface{}{ROLE_CUSTOMER}},
+		{"customers", UserFilter{Staff: &customers}, " WHERE u.role=$1", []interface{}{ROLE_CUSTOMER}},
+		{"created between", UserFilter{CreatedFrom: &from, CreatedTo: &to},
+			" WHERE u.created_at>=$1 AND u.created_at<=$2", []interface{}{from, to}},
+		{"search", UserFilter{Search: "ann"},
+			" WHERE (u.email ILIKE $1 OR u.username ILIKE $1)", []interface{}{"%ann%"}},
+		{"search escaped", UserFilter{Search: `50%_off\`},
+			" WHERE (u.email ILIKE $1 OR u.username ILIKE $1)", []interface{}{`%50\%\_off\\%`}},
+		{"all of them", UserFilter{Staff: &staff, CreatedFrom: &from, CreatedTo: &to, Search: "ann"},
+			" WHERE u.role<>$1 AND u.created_at>=$2 AND u.created_at<=$3 AND (u.email ILIKE $4 OR u.username ILIKE $4)",
+			[]interface{}{ROLE_CUSTOMER, from, to, "%ann%"}},
+	}
+	for _, c := range cases {
+		where, args := c.filter.where()
+		if where != c.where || !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%s: got %q %v, want %q %v", c.name, where, args, c.where, c.args)
+		}
+	}
+}
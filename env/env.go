@@ -0,0 +1,34 @@
+// Package env reads the settings of the service from the environment variables. They are only
+// read once the .env file has been loaded, that is, from main or the constructors it calls,
+// never into package level variables.
+package env
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// Get returns the value of the variable, defaultValue if it is unset or empty.
+func Get(key, defaultValue string) string {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue
+	}
+	return val
+}
+
+// Int returns the value of the variable as a number, defaultValue if it is unset, empty or
+// not a number, which is logged.
+func Int(key string, defaultValue int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(val)
+	if err != nil {
+		log.Printf("WARNING. Unable to parse %s, using %d.", key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// SMTPMailer delivers messages through an SMTP relay. Authentication (PLAIN) is only
+// attempted when Username is set.
+type SMTPMailer struct {
+	Host, Port, Username, Password, From string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := fmt.Sprintf("%s:%s", m.Host, m.Port)
+	return smtp.SendMail(addr, auth, m.From, []string{msg.To}, format(m.From, msg))
+}
+
+// OutboxMailer writes messages to a file or stdout instead of sending them,
+// for development and tests.
+type OutboxMailer struct {
+	From string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+// NewOutboxMailer appends messages to the file at path, or writes them to stdout
+// if path is empty or "-".
+func NewOutboxMailer(path, from string) (*OutboxMailer, error) {
+	if path == "" || path == "-" {
+		return &OutboxMailer{From: from, w: os.Stdout}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxMailer{From: from, w: f}, nil
+}
+
+func (m *OutboxMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := fmt.Fprintf(m.w, "%s\r\n.\r\n", format(m.From, msg))
+	return err
+}
+
+func format(from string, msg Message) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", headerValue(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerValue(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerValue(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// headerValue strips line breaks, so that no extra headers can be smuggled in.
+func headerValue(v string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(v)
+}
@@ -4,22 +4,16 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 
 	"db-queries/controllers"
 	"db-queries/db"
+	"db-queries/env"
+	"db-queries/mailer"
+	"db-queries/passwords"
 
 	"github.com/joho/godotenv"
 )
 
-func GetEnv(key, defaultValue string) string {
-	val := os.Getenv(key)
-	if val == "" {
-		return defaultValue
-	}
-	return val
-}
-
 func main() {
 	err := godotenv.Load()
 	if err != nil {
@@ -27,15 +21,7 @@ func main() {
 	}
 
 	log.Println("Initializing DB connection.")
-	conn, err := db.Initialize(
-		&db.DSN{
-			HOST:     GetEnv("DB_HOST", "db"),
-			PORT:     GetEnv("DB_PORT", "5432"),
-			USERNAME: GetEnv("DB_USER", "postgres"),
-			PASSWORD: GetEnv("DB_PASSWORD", "postgres"),
-			DATABASE: GetEnv("DB_NAME", "tickets"),
-		},
-	)
+	conn, err := db.Initialize(db.NewDSNFromEnv())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -46,17 +32,92 @@ func main() {
 		log.Fatal(err)
 	}
 
+	log.Println("Loading JWT keys.")
+	var keys *controllers.KeySet
+	keysDir := env.Get("JWT_KEYS_DIR", "")
+	switch {
+	case keysDir == "" && env.Get("JWT_EPHEMERAL_KEYS", "false") == "true":
+		log.Println("WARNING. Signing tokens with an ephemeral key, every restart logs everybody out.")
+		keys, err = controllers.NewEphemeralKeySet()
+	case keysDir == "":
+		log.Fatal("JWT_KEYS_DIR not set. Set JWT_EPHEMERAL_KEYS=true to sign with an ephemeral key in development.")
+	default:
+		keys, err = controllers.LoadKeySet(keysDir, env.Get("JWT_ACTIVE_KID", ""))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Initializing mailer.")
+	var m mailer.Mailer
+	mailFrom := env.Get("MAIL_FROM", "support@localhost")
+	switch env.Get("MAILER", "outbox") {
+	case "smtp":
+		m = &mailer.SMTPMailer{
+			Host:     env.Get("SMTP_HOST", "localhost"),
+			Port:     env.Get("SMTP_PORT", "587"),
+			Username: env.Get("SMTP_USERNAME", ""),
+			Password: env.Get("SMTP_PASSWORD", ""),
+			From:     mailFrom,
+		}
+	default:
+		m, err = mailer.NewOutboxMailer(env.Get("MAIL_OUTBOX", ""), mailFrom)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Println("Loading password policy.")
+	passwords.LoadCostFromEnv()
+	policy, err := passwords.NewPolicyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config := controllers.NewConfigFromEnv()
+	oidcProvider, err := controllers.NewOIDCProviderFromEnv(config.PublicURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Println("Registering routes.")
-	h := controllers.NewBaseHandler(conn)
+	h := controllers.NewBaseHandler(conn, keys, m, policy, config)
+	h.OIDC = oidcProvider
 	http.HandleFunc("/time", h.Pong)
+	http.HandleFunc("/.well-known/jwks.json", h.JWKS)
 	http.HandleFunc("/users", h.UsersListAllOrCreateOne)
+	http.HandleFunc("/users/verify", h.UsersVerifyEmail)
+	http.Handle("/users/", h.JWTMiddleWare(h.UsersDetailedView))
 	http.HandleFunc("/login", h.LogIn)
-	http.Handle("/tickets", controllers.JWTMiddleWare(h.TicketsListAllOrCreateOne))
-	http.Handle("/tickets/", controllers.JWTMiddleWare(h.TicketsDetailedView))
+	http.HandleFunc("/login/mfa", h.LogInMFA)
+	http.HandleFunc("/auth/oidc/login", h.OIDCLogIn)
+	http.HandleFunc("/auth/oidc/callback", h.OIDCCallback)
+	http.HandleFunc("/refresh", h.Refresh)
+	http.HandleFunc("/password/forgot", h.ForgotPassword)
+	http.HandleFunc("/password/reset", h.ResetPassword)
+	http.HandleFunc("/password/policy", h.PasswordPolicy)
+	http.Handle("/logout", h.JWTMiddleWare(h.LogOut))
+	http.Handle("/me/password", h.JWTMiddleWare(h.ChangePassword))
+	http.Handle("/me", h.JWTMiddleWare(h.Me))
+	http.Handle("/me/email", h.JWTMiddleWare(h.ChangeEmail))
+	http.Handle("/me/logins", h.JWTMiddleWare(h.MyLogins))
+	http.Handle("/me/export", h.JWTMiddleWare(h.MyExport))
+	http.Handle("/me/tokens", h.JWTMiddleWare(h.PersonalTokensListAllOrCreateOne))
+	http.Handle("/me/tokens/", h.JWTMiddleWare(h.PersonalTokensDetailedView))
+	http.Handle("/me/2fa/enroll", h.MFAEnrollMiddleWare(h.EnrollTotp))
+	http.Handle("/me/2fa/confirm", h.MFAEnrollMiddleWare(h.ConfirmTotp))
+	http.Handle("/me/2fa/disable", h.JWTMiddleWare(h.DisableTotp))
+	http.Handle("/api-keys", h.JWTMiddleWare(h.ApiKeysListAllOrCreateOne))
+	http.Handle("/api-keys/", h.JWTMiddleWare(h.ApiKeysDetailedView))
+	http.Handle("/tickets", h.JWTOrApiKeyMiddleWare(h.TicketsListAllOrCreateOne))
+	http.Handle("/tickets/", h.JWTOrApiKeyMiddleWare(h.TicketsDetailedView))
+
+	log.Println("Starting purge of old login events.")
+	go h.PurgeLoginEvents()
 
 	log.Println("Initializing HTTP server.")
-	host := GetEnv("SERVER_HOST", "0.0.0.0")
-	port := GetEnv("SERVER_PORT", "8089")
+	host := env.Get("SERVER_HOST", "0.0.0.0")
+	port := env.Get("SERVER_PORT", "8089")
 	servAddr := fmt.Sprintf("%s:%s", host, port)
 	s := &http.Server{Addr: servAddr}
 
@@ -0,0 +1,213 @@
+// Package oidc is a client of OpenID Connect providers for the authorization code flow
+// with PKCE, just enough to let users log in with an identity they already have.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const DISCOVERY_PATH = "/.well-known/openid-configuration"
+const HTTP_TIMEOUT_SECS = 10
+
+var (
+	ErrIssuerMismatch = errors.New("oidc: issuer in the discovery document does not match")
+	ErrNonceMismatch  = errors.New("oidc: nonce mismatch")
+	ErrUnknownKey     = errors.New("oidc: unknown signing key")
+)
+
+// Discovery is the part of the provider's metadata the client needs.
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// IDTokenClaims are the claims of the ID token the users are provisioned from.
+type IDTokenClaims struct {
+	Email             string   `json:"email"`
+	EmailVerified     *bool    `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+	Groups            []string `json:"groups"`
+	Nonce             string   `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+type Provider struct {
+	Discovery
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	client *http.Client
+	mu     sync.Mutex
+	keys   map[string]interface{}
+}
+
+// Discover fetches the provider's metadata from the issuer's discovery document.
+func Discover(issuer, clientID, clientSecret, redirectURL string, scopes []string) (*Provider, error) {
+	p := &Provider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+		client:       &http.Client{Timeout: HTTP_TIMEOUT_SECS * time.Second},
+	}
+
+	if err := p.getJSON(strings.TrimSuffix(issuer, "/")+DISCOVERY_PATH, &p.Discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, ErrIssuerMismatch
+	}
+	return p, nil
+}
+
+// NewCodeVerifier returns a random PKCE code verifier, or a state or nonce value.
+func NewCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge derives the S256 PKCE code challenge from the verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL is where the user is sent to log in with the provider.
+func (p *Provider) AuthCodeURL(state, nonce, codeVerifier string) string {
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {CodeChallenge(codeVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.AuthorizationEndpoint + separator + params.Encode()
+}
+
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange trades the authorization code for the tokens and returns the verified claims
+// of the ID token.
+func (p *Provider) Exchange(code, codeVerifier, nonce string) (*IDTokenClaims, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var tokens tokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("oidc: token response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token request failed with %d: %s %s", res.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+	return p.VerifyIDToken(tokens.IDToken, nonce)
+}
+
+// VerifyIDToken checks the ID token's signature against the provider's keys, its issuer,
+// audience, expiry and nonce.
+func (p *Provider) VerifyIDToken(rawToken, nonce string) (*IDTokenClaims, error) {
+	claims := &IDTokenClaims{}
+	_, err := jwt.ParseWithClaims(rawToken, claims, p.keyFunc)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: id token: %w", err)
+	}
+
+	if !claims.VerifyIssuer(p.Issuer, true) {
+		return nil, fmt.Errorf("oidc: id token issued by %q", claims.Issuer)
+	}
+	if !claims.VerifyAudience(p.ClientID, true) {
+		return nil, fmt.Errorf("oidc: id token not meant for %q", p.ClientID)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("oidc: id token without subject")
+	}
+	if claims.Nonce != nonce {
+		return nil, ErrNonceMismatch
+	}
+	return claims, nil
+}
+
+// keyFunc looks the key up by the token's kid, refetching the provider's keys once if
+// the kid is unknown, since providers rotate their keys.
+func (p *Provider) keyFunc(tkn *jwt.Token) (interface{}, error) {
+	kid, _ := tkn.Header["kid"].(string)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[kid]
+	if !ok {
+		keys, err := p.fetchKeys()
+		if err != nil {
+			return nil, err
+		}
+		p.keys = keys
+		if key, ok = p.keys[kid]; !ok {
+			return nil, ErrUnknownKey
+		}
+	}
+
+	if !methodFitsKey(tkn.Method, key) {
+		return nil, fmt.Errorf("oidc: %s not expected for key %q", tkn.Method.Alg(), kid)
+	}
+	return key, nil
+}
+
+func (p *Provider) getJSON(url string, v interface{}) error {
+	res, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s responded with %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
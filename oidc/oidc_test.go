@@ -0,0 +1,114 @@
+package oidc_test
+
+import (
+	"db-queries/oidc"
+	"db-queries/oidc/mockidp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const redirectURL = "http://service.test/auth/oidc/callback"
+
+func startProvider(t *testing.T) (*mockidp.Provider, *oidc.Provider) {
+	t.Helper()
+	idp, err := mockidp.New("", "ticket-service", "secret", "agent@corp.io", "support-agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(idp.Handler())
+	t.Cleanup(srv.Close)
+	idp.Issuer = srv.URL
+
+	provider, err := oidc.Discover(srv.URL, "ticket-service", "secret", redirectURL, []string{"openid", "email"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idp, provider
+}
+
+// authorize follows the login at the provider and returns the query it redirects back with.
+func authorize(t *testing.T, authURL string) url.Values {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize responded with %d", res.StatusCode)
+	}
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query()
+}
+
+func newVerifier(t *testing.T) string {
+	t.Helper()
+	verifier, err := oidc.NewCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifier
+}
+
+func TestExchange(t *testing.T) {
+	idp, provider := startProvider(t)
+	verifier := newVerifier(t)
+
+	callback := authorize(t, provider.AuthCodeURL("the-state", "the-nonce", verifier)+"&groups=support-leads")
+	if callback.Get("state") != "the-state" {
+		t.Fatalf("state %q sent back, want the-state", callback.Get("state"))
+	}
+
+	claims, err := provider.Exchange(callback.Get("code"), verifier, "the-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Email != "agent@corp.io" || claims.Issuer != idp.Issuer || claims.Subject == "" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if len(claims.Groups) != 1 || claims.Groups[0] != "support-leads" {
+		t.Errorf("groups %v, want [support-leads]", claims.Groups)
+	}
+
+	if _, err := provider.Exchange(callback.Get("code"), verifier, "the-nonce"); err == nil {
+		t.Error("code accepted twice")
+	}
+}
+
+func TestExchangeRejectsWrongCodeVerifier(t *testing.T) {
+	_, provider := startProvider(t)
+
+	callback := authorize(t, provider.AuthCodeURL("state", "nonce", newVerifier(t)))
+	if _, err := provider.Exchange(callback.Get("code"), newVerifier(t), "nonce"); err == nil {
+		t.Error("code exchanged with another code verifier")
+	}
+}
+
+func TestExchangeRejectsWrongNonce(t *testing.T) {
+	_, provider := startProvider(t)
+	verifier := newVerifier(t)
+
+	callback := authorize(t, provider.AuthCodeURL("state", "nonce", verifier))
+	if _, err := provider.Exchange(callback.Get("code"), verifier, "another-nonce"); err != oidc.ErrNonceMismatch {
+		t.Errorf("got %v, want ErrNonceMismatch", err)
+	}
+}
+
+func TestExchangeRejectsWrongClientSecret(t *testing.T) {
+	_, provider := startProvider(t)
+	provider.ClientSecret = "not-the-secret"
+	verifier := newVerifier(t)
+
+	callback := authorize(t, provider.AuthCodeURL("state", "nonce", verifier))
+	if _, err := provider.Exchange(callback.Get("code"), verifier, "nonce"); err == nil {
+		t.Error("code exchanged with a wrong client secret")
+	}
+}
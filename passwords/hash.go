@@ -0,0 +1,112 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"db-queries/env"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	ARGON2_SALT_LENGTH = 16
+	ARGON2_KEY_LENGTH  = 32
+	// NO_PASSWORD is stored for the users who have not set a password, no password matches it.
+	NO_PASSWORD = "!"
+)
+
+// The argon2id cost, RFC 9106's second recommended option by default, see LoadCostFromEnv.
+// Hashes made with other parameters are upgraded on the next successful login.
+var (
+	ARGON2_MEMORY_KIB = 64 * 1024
+	ARGON2_TIME       = 3
+	ARGON2_THREADS    = 4
+)
+
+// LoadCostFromEnv reads the argon2id cost from the PASSWORD_ARGON2_* envvars, the defaults
+// for the ones not set. It is called once the .env file has been loaded.
+func LoadCostFromEnv() {
+	ARGON2_MEMORY_KIB = env.Int("PASSWORD_ARGON2_MEMORY_KIB", 64*1024)
+	ARGON2_TIME = env.Int("PASSWORD_ARGON2_TIME", 3)
+	ARGON2_THREADS = env.Int("PASSWORD_ARGON2_THREADS", 4)
+}
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func currentParams() argon2Params {
+	return argon2Params{uint32(ARGON2_MEMORY_KIB), uint32(ARGON2_TIME), uint8(ARGON2_THREADS)}
+}
+
+// Hash returns the argon2id hash of the password in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func Hash(password string) (string, error) {
+	salt := make([]byte, ARGON2_SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	p := currentParams()
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, ARGON2_KEY_LENGTH)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks the password against the hash, which is either an argon2id one or a bcrypt
+// one left by pgcrypto, which the passwords used to be hashed with. needsRehash reports
+// whether the hash should be replaced with one made by Hash.
+func Verify(password, hash string) (ok, needsRehash bool, err error) {
+	switch {
+	case hash == NO_PASSWORD:
+		return false, false, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2(password, hash)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+		return err == nil, true, err
+	}
+	return false, false, ErrUnknownHashFormat
+}
+
+func verifyArgon2(password, hash string) (ok, needsRehash bool, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, false, ErrUnknownHashFormat
+	}
+
+	var version int
+	var p argon2Params
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(candidate, key) != 1 {
+		return false, false, nil
+	}
+	return true, version != argon2.Version || p != currentParams() || len(key) != ARGON2_KEY_LENGTH, nil
+}
@@ -0,0 +1,82 @@
+package passwords
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashVerify(t *testing.T) {
+	hash, err := Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$", ARGON2_MEMORY_KIB, ARGON2_TIME, ARGON2_THREADS)
+	if !strings.HasPrefix(hash, prefix) {
+		t.Errorf("got %s, want it to start with %s", hash, prefix)
+	}
+
+	if ok, needsRehash, err := Verify("correct horse", hash); !ok || needsRehash || err != nil {
+		t.Errorf("right password: got %v, %v, %v, want true, false, nil", ok, needsRehash, err)
+	}
+	if ok, needsRehash, err := Verify("correct horse ", hash); ok || needsRehash || err != nil {
+		t.Errorf("wrong password: got %v, %v, %v, want false, false, nil", ok, needsRehash, err)
+	}
+}
+
+func TestHashSalted(t *testing.T) {
+	first, _ := Hash("correct horse")
+	second, _ := Hash("correct horse")
+	if first == second {
+		t.Error("the same password hashed the same twice")
+	}
+}
+
+func TestVerifyRehashOnCostChange(t *testing.T) {
+	hash, err := Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(time int) { ARGON2_TIME = time }(ARGON2_TIME)
+	ARGON2_TIME++
+	if ok, needsRehash, err := Verify("correct horse", hash); !ok || !needsRehash || err != nil {
+		t.Errorf("got %v, %v, %v, want true, true, nil", ok, needsRehash, err)
+	}
+}
+
+func TestVerifyBcrypt(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pgcrypto's crypt() with gen_salt('bf') makes $2a$ hashes.
+	if !strings.HasPrefix(string(legacy), "$2a$") {
+		t.Fatalf("got %s, want a $2a$ hash", legacy)
+	}
+
+	if ok, needsRehash, err := Verify("correct horse", string(legacy)); !ok || !needsRehash || err != nil {
+		t.Errorf("right password: got %v, %v, %v, want true, true, nil", ok, needsRehash, err)
+	}
+	if ok, needsRehash, err := Verify("wrong horse", string(legacy)); ok || needsRehash || err != nil {
+		t.Errorf("wrong password: got %v, %v, %v, want false, false, nil", ok, needsRehash, err)
+	}
+}
+
+func TestVerifyNoPassword(t *testing.T) {
+	for _, password := range []string{"", NO_PASSWORD} {
+		if ok, needsRehash, err := Verify(password, NO_PASSWORD); ok || needsRehash || err != nil {
+			t.Errorf("%q: got %v, %v, %v, want false, false, nil", password, ok, needsRehash, err)
+		}
+	}
+}
+
+func TestVerifyUnknownFormat(t *testing.T) {
+	for _, hash := range []string{"", "correct horse", "$argon2id$v=19$m=65536", "$argon2id$v=19$m=x,t=3,p=4$c2FsdA$a2V5"} {
+		if ok, _, err := Verify("correct horse", hash); ok || err != ErrUnknownHashFormat {
+			t.Errorf("%q: got %v, %v, want false, %v", hash, ok, err, ErrUnknownHashFormat)
+		}
+	}
+}
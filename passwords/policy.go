@@ -0,0 +1,103 @@
+// Package passwords holds the rules the passwords chosen by the users have to follow.
+package passwords
+
+import (
+	"bufio"
+	"db-queries/env"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MAX_LENGTH_BYTES bounds the passwords whatever the policy, so that hashing one stays cheap.
+const MAX_LENGTH_BYTES = 256
+
+var ErrBreached = errors.New("Password found among breached passwords, please choose another one.")
+
+type Policy struct {
+	// MinLength is counted in characters, not bytes.
+	MinLength int `json:"minLength"`
+	// MinCharClasses is the number of character classes (lowercase and uppercase letters,
+	// digits, symbols) a password has to mix.
+	MinCharClasses int `json:"minCharClasses"`
+	// breached passwords, lowercased.
+	breached map[string]bool
+}
+
+// NewPolicyFromEnv reads the policy from the PASSWORD_* envvars. PASSWORD_BREACHED_LIST is
+// the path to a file with one known breached password per line.
+func NewPolicyFromEnv() (*Policy, error) {
+	policy := &Policy{
+		MinLength:      env.Int("PASSWORD_MIN_LENGTH", 8),
+		MinCharClasses: env.Int("PASSWORD_MIN_CHAR_CLASSES", 1),
+	}
+
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		breached, err := LoadBreachedList(path)
+		if err != nil {
+			return nil, err
+		}
+		policy.breached = breached
+	}
+	return policy, nil
+}
+
+func LoadBreachedList(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	breached := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			breached[strings.ToLower(line)] = true
+		}
+	}
+	return breached, scanner.Err()
+}
+
+// Validate returns an error, fit for showing to the user, if the password breaks the policy.
+func (p *Policy) Validate(password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("Password min length is %d.", p.MinLength)
+	}
+	if len(password) > MAX_LENGTH_BYTES {
+		return fmt.Errorf("Password max length is %d bytes.", MAX_LENGTH_BYTES)
+	}
+	if charClasses(password) < p.MinCharClasses {
+		return fmt.Errorf("Password must mix at least %d of: lowercase letters, uppercase letters, digits, symbols.",
+			p.MinCharClasses)
+	}
+	if p.breached[strings.ToLower(password)] {
+		return ErrBreached
+	}
+	return nil
+}
+
+// BreachedListSize is the number of passwords in the breached list, 0 if none loaded.
+func (p *Policy) BreachedListSize() int {
+	return len(p.breached)
+}
+
+func charClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
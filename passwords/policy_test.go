@@ -0,0 +1,85 @@
+package passwords
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	policy := &Policy{MinLength: 10, MinCharClasses: 3, breached: map[string]bool{"password123!": true}}
+
+	accepted := []string{"correctHorse1", "correct-Horse", "CORRECT horse", "пароль-Horse1"}
+	for _, password := range accepted {
+		if err := policy.Validate(password); err != nil {
+			t.Errorf("%q refused: %v", password, err)
+		}
+	}
+
+	refused := []string{"", "short1A!", "correcthorse", "correct horse", "CORRECTHORSE1", "Password123!", "PASSWORD123!",
+		"Äpfel-öl1", strings.Repeat("correct-Horse1", 19)}
+	for _, password := range refused {
+		if err := policy.Validate(password); err == nil {
+			t.Errorf("%q accepted", password)
+		}
+	}
+	// Counted in characters: "Äpfel-öl1" above has 9 of them in 11 bytes.
+	if err := policy.Validate("Äpfel-öl-1"); err != nil {
+		t.Errorf("10 characters refused: %v", err)
+	}
+	if err := policy.Validate(strings.Repeat("Correct-horse1", 18) + "Abcd"); err != nil {
+		t.Errorf("256 bytes refused: %v", err)
+	}
+	if err := policy.Validate("Password123!"); err != ErrBreached {
+		t.Errorf("got %v for a breached password, want %v", err, ErrBreached)
+	}
+}
+
+func TestCharClasses(t *testing.T) {
+	cases := []struct {
+		password string
+		classes  int
+	}{
+		{"", 0},
+		{"abc", 1},
+		{"abcDEF", 2},
+		{"abcDEF123", 3},
+		{"abcDEF123 ", 4},
+		{"ÄÖü", 2},
+	}
+	for _, c := range cases {
+		if got := charClasses(c.password); got != c.classes {
+			t.Errorf("%q: got %d, want %d", c.password, got, c.classes)
+		}
+	}
+}
+
+func TestLoadBreachedList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte("Password1\n\n  qwerty  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	breached, err := LoadBreachedList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breached) != 2 || !breached["password1"] || !breached["qwerty"] {
+		t.Errorf("got %v, want password1 and qwerty", breached)
+	}
+}
+
+func TestNewPolicyFromEnv(t *testing.T) {
+	t.Setenv("PASSWORD_MIN_LENGTH", "12")
+	t.Setenv("PASSWORD_MIN_CHAR_CLASSES", "not a number")
+	t.Setenv("PASSWORD_BREACHED_LIST", "")
+
+	policy, err := NewPolicyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.MinLength != 12 || policy.MinCharClasses != 1 || policy.BreachedListSize() != 0 {
+		t.Errorf("got %+v, want min length 12, the default 1 class and no breached list", policy)
+	}
+}
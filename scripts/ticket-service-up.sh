@@ -1,7 +1,16 @@
 #!/bin/bash
 
-export JWT_KEY=jwtkey 
-export STAFF_TOKEN=stafftoken 
+export JWT_KEYS_DIR=${JWT_KEYS_DIR:-}
+export JWT_ACTIVE_KID=${JWT_ACTIVE_KID:-}
+export JWT_EPHEMERAL_KEYS=${JWT_EPHEMERAL_KEYS:-}
+
+# The app refuses to start without signing keys, ./keys is mounted at /keys.
+if [ -z "$JWT_KEYS_DIR" ] && [ "$JWT_EPHEMERAL_KEYS" != "true" ]; then
+    export JWT_KEYS_DIR=/keys
+    export JWT_ACTIVE_KID=${JWT_ACTIVE_KID:-default}
+    [ -f "keys/$JWT_ACTIVE_KID.pem" ] || make keys KID="$JWT_ACTIVE_KID"
+fi
+export MAILER=${MAILER:-outbox}
 export DB_USER=dbuser 
 export DB_PASSWORD=dbpassword 
 export DB_NAME=dbname 
@@ -0,0 +1,88 @@
+// Package totp implements time-based one-time passwords as described in RFC 6238,
+// with the defaults authenticator apps expect: HMAC-SHA1, 6 digits, 30 second steps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DIGITS      = 6
+	PERIOD_SECS = 30
+	SECRET_SIZE = 20
+	// Number of steps before and after the current one a code is still accepted for,
+	// to make up for clock drift and typing time.
+	SKEW = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func GenerateSecret() (string, error) {
+	b := make([]byte, SECRET_SIZE)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+func Step(t time.Time) int64 {
+	return t.Unix() / PERIOD_SECS
+}
+
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < DIGITS; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", DIGITS, value%modulus), nil
+}
+
+// Validate checks the code against the steps around t and returns the step it matched,
+// so that the caller can refuse to accept the same (or an older) step twice.
+func Validate(secret, code string, t time.Time) (step int64, ok bool) {
+	current := Step(t)
+	for s := current - SKEW; s <= current+SKEW; s++ {
+		expected, err := Code(secret, s)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// URI builds the otpauth:// URI authenticator apps import (usually via a QR code).
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(DIGITS))
+	params.Set("period", fmt.Sprint(PERIOD_SECS))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
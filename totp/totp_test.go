@@ -0,0 +1,76 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The ASCII secret "12345678901234567890" of the SHA1 test vectors of RFC 6238, appendix B.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238Vectors(t *testing.T) {
+	// The RFC lists 8 digit codes, the 6 digit ones are their last 6 digits.
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, c := range cases {
+		code, err := Code(rfcSecret, Step(time.Unix(c.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := c.code[len(c.code)-DIGITS:]; code != want {
+			t.Errorf("at %d: got %s, want %s", c.unix, code, want)
+		}
+	}
+}
+
+func TestCodeLowercaseSecret(t *testing.T) {
+	code, err := Code(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil || code != "287082" {
+		t.Errorf("got %q, %v, want 287082", code, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	for offset := int64(-SKEW); offset <= SKEW; offset++ {
+		code, _ := Code(rfcSecret, current+offset)
+		step, ok := Validate(rfcSecret, code, now)
+		if !ok || step != current+offset {
+			t.Errorf("code of step %+d: got step %d, %v, want %d, true", offset, step, ok, current+offset)
+		}
+	}
+	for _, offset := range []int64{-SKEW - 1, SKEW + 1} {
+		code, _ := Code(rfcSecret, current+offset)
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("code of step %+d accepted", offset)
+		}
+	}
+	if _, ok := Validate("not base32!", "123456", now); ok {
+		t.Error("code of an invalid secret accepted")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Code(secret, 0); err != nil {
+		t.Errorf("generated secret %q does not decode: %v", secret, err)
+	}
+	if other, _ := GenerateSecret(); other == secret {
+		t.Error("generated the same secret twice")
+	}
+}